@@ -0,0 +1,69 @@
+package main
+
+// Disk write accounting
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// writeAccounting counts the bytes each subsystem writes to disk, to gauge
+// SD card wear
+type writeAccounting struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+}
+
+// diskWrites accounts all file writes of the daemon
+var diskWrites = &writeAccounting{bytes: make(map[string]int64)}
+
+// writer wraps w so that writes through it are accounted to subsystem
+func (a *writeAccounting) writer(subsystem string, w io.Writer) io.Writer {
+	return &accountingWriter{w: w, subsystem: subsystem, acct: a}
+}
+
+func (a *writeAccounting) add(subsystem string, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.bytes[subsystem] += int64(n)
+}
+
+// totals returns the bytes written per subsystem, ordered by name
+func (a *writeAccounting) totals() ([]string, []int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := make([]string, 0, len(a.bytes))
+	for name := range a.bytes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	totals := make([]int64, len(names))
+	for i, name := range names {
+		totals[i] = a.bytes[name]
+	}
+	return names, totals
+}
+
+func (a *writeAccounting) String() string {
+	names, totals := a.totals()
+	parts := make([]string, len(names))
+	for i := range names {
+		parts[i] = fmt.Sprintf("%s=%d", names[i], totals[i])
+	}
+	return strings.Join(parts, " ")
+}
+
+type accountingWriter struct {
+	w         io.Writer
+	subsystem string
+	acct      *writeAccounting
+}
+
+func (a *accountingWriter) Write(p []byte) (int, error) {
+	n, err := a.w.Write(p)
+	a.acct.add(a.subsystem, n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package main
+
+// Temperature alert emails
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+type alerter struct {
+	addr      string
+	from      string
+	to        []string
+	auth      smtp.Auth
+	threshold int
+	cooldown  time.Duration
+
+	alerting bool
+	lastSent time.Time
+}
+
+func newAlerter(host string, port int, user string, password string, from string, to string, threshold int, cooldown int) (*alerter, error) {
+	if host == "" || from == "" || to == "" {
+		return nil, fmt.Errorf("'-alert-temp' requires '-smtp-host', '-smtp-from' and '-smtp-to'")
+	}
+	a := &alerter{
+		addr:      fmt.Sprintf("%s:%d", host, port),
+		from:      from,
+		to:        strings.Split(to, ","),
+		threshold: threshold,
+		cooldown:  time.Duration(cooldown) * time.Second,
+	}
+	if user != "" {
+		a.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return a, nil
+}
+
+// check sends an alert when the temperature reaches the threshold and a
+// recovery once it drops back below. At most one email is sent per cooldown;
+// a state change inside the cooldown is picked up on a later poll.
+func (a *alerter) check(temp int) {
+	if a.alerting == (temp >= a.threshold) {
+		return
+	}
+	if !a.lastSent.IsZero() && time.Since(a.lastSent) < a.cooldown {
+		return
+	}
+	a.alerting = !a.alerting
+	a.lastSent = time.Now()
+
+	host, _ := os.Hostname()
+	subject := fmt.Sprintf("PiFan alert on %s: temperature %d", host, temp)
+	if !a.alerting {
+		subject = fmt.Sprintf("PiFan recovery on %s: temperature %d", host, temp)
+	}
+	body := fmt.Sprintf("CPU temperature: %d (alert threshold: %d)", temp, a.threshold)
+
+	// never block the control loop on SMTP
+	go a.send(subject, body)
+}
+
+func (a *alerter) send(subject string, body string) {
+	msg := "From: " + a.from + "\r\n" +
+		"To: " + strings.Join(a.to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" +
+		body + "\r\n"
+	if err := smtp.SendMail(a.addr, a.auth, a.from, a.to, []byte(msg)); err != nil {
+		log.Printf("Unable to send alert email: %v\n", err)
+		return
+	}
+	log.Printf("Alert email sent: %s\n", subject)
+}
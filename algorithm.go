@@ -0,0 +1,58 @@
+package main
+
+// Control algorithms
+
+import (
+	"fmt"
+)
+
+// Algorithm decides the fan speed for a reading given the current
+// temperature driven speed
+type Algorithm interface {
+	Decide(temp int, level int) int
+}
+
+// hysteresis switches the fan fully on at start and off at stop
+type hysteresis struct {
+	start int
+	stop  int
+}
+
+func (h hysteresis) Decide(temp int, level int) int {
+	if fanDecision(temp, h.start, h.stop, level > speedOff) {
+		return speedHigh
+	}
+	return speedOff
+}
+
+// twoSpeed runs the fan at low speed from mid and at high speed from start
+type twoSpeed struct {
+	start int
+	mid   int
+	stop  int
+}
+
+func (t twoSpeed) Decide(temp int, level int) int {
+	return speedDecision(temp, t.start, t.mid, t.stop, level)
+}
+
+// newAlgorithm returns the algorithm for -control-mode. "auto" picks
+// "two-speed" for two speed fans and "hysteresis" otherwise.
+func newAlgorithm(mode string, twoSpeedFan bool, start int, mid int, stop int) (Algorithm, error) {
+	if mode == "auto" {
+		mode = "hysteresis"
+		if twoSpeedFan {
+			mode = "two-speed"
+		}
+	}
+	switch mode {
+	case "hysteresis":
+		return hysteresis{start: start, stop: stop}, nil
+	case "two-speed":
+		if !twoSpeedFan {
+			return nil, fmt.Errorf("control mode %q requires '-gpio-high' or '-gpio-pair'", mode)
+		}
+		return twoSpeed{start: start, mid: mid, stop: stop}, nil
+	}
+	return nil, fmt.Errorf("invalid control-mode %q (expected 'auto', 'hysteresis' or 'two-speed')", mode)
+}
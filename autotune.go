@@ -0,0 +1,71 @@
+package main
+
+// Threshold suggestions
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// autotune observes the temperature for the given duration, first with the
+// fan off and then with the fan on, and prints suggested thresholds. The
+// fan off phase ends early once the current start threshold is reached.
+// Nothing is persisted.
+func (c *controller) autotune(duration time.Duration, out io.Writer) error {
+	interval := time.Duration(c.timeout) * time.Second
+	deadline := time.Now().Add(duration / 2)
+
+	log.Printf("Autotune: observing with the fan off for up to %v\n", duration/2)
+	c.forceFan(speedOff)
+	offMin, offMax, err := c.observe(deadline, interval, c.start)
+	if err != nil {
+		return err
+	}
+
+	deadline = time.Now().Add(duration / 2)
+	log.Printf("Autotune: observing with the fan on for %v\n", duration/2)
+	c.forceFan(speedHigh)
+	onMin, onMax, err := c.observe(deadline, interval, 0)
+	if err != nil {
+		return err
+	}
+
+	// stop a little above what the fan can reach, start halfway up to
+	// where the Pi settles without it
+	stop := onMin + 2
+	start := stop + (offMax-onMin)/2
+	if start < stop+3 {
+		start = stop + 3
+	}
+
+	fmt.Fprintf(out, "Fan off: %v..%v\n", offMin, offMax)
+	fmt.Fprintf(out, "Fan on:  %v..%v\n", onMin, onMax)
+	fmt.Fprintf(out, "Suggested: -start %v -stop %v\n", start, stop)
+	return nil
+}
+
+// observe samples the temperature until the deadline, or until it reaches
+// limit when limit is positive, and returns the range seen
+func (c *controller) observe(deadline time.Time, interval time.Duration, limit int) (int, int, error) {
+	min, max := 0, 0
+	for first := true; first || time.Now().Before(deadline); first = false {
+		cpuTemp, err := c.readTemp()
+		if err != nil {
+			return 0, 0, err
+		}
+		if first || cpuTemp < min {
+			min = cpuTemp
+		}
+		if first || cpuTemp > max {
+			max = cpuTemp
+		}
+		if limit > 0 && cpuTemp >= limit {
+			log.Printf("Autotune: reached %v, ending phase early\n", cpuTemp)
+			break
+		}
+		time.Sleep(interval)
+	}
+	return min, max, nil
+}
@@ -0,0 +1,680 @@
+package main
+
+// Fan control loop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// controller holds the control loop settings and the commanded fan state
+type controller struct {
+	start   int
+	stop    int
+	timeout int
+	// poll intervals while cool with the fan off, and while warm or cooling
+	intervalIdle   int
+	intervalActive int
+	lastInterval   int
+	jitter         int
+	thermal        string
+	// name of the control input in logs
+	input string
+	// source reads the temperature; defaults to the thermal file
+	source      func() (int, error)
+	readTimeout time.Duration
+	// read still running after a timeout, collected by the next read
+	pending  chan sourceResult
+	minValid int
+	maxValid int
+	// optional range valid readings are clamped into before the decision
+	clampMin *int
+	clampMax *int
+	// routine logging is suppressed below this value, nil when not set
+	quietBelow    *int
+	reassert      time.Duration
+	logDelta      int
+	minOnCycles   int
+	debounceCount int
+	purgeInterval time.Duration
+	purgeDuration time.Duration
+	fan           Fan
+	// decides the speed from the readings
+	algorithm Algorithm
+	// two speed fan or fan pair, if configured; pair is rotated by the loop
+	speed    speedFan
+	pair     *fanPair
+	alert    *alerter
+	ui       *tui
+	textfile *textfile
+	stats    *stats
+
+	// consecutive read failures before holding the fan state and before
+	// forcing it on (0: disabled); with neither set the first failure is
+	// fatal
+	holdErrors     int
+	failsafeErrors int
+	readErrors     int
+	// last valid reading, logged with failsafe transitions
+	lastTemp int
+
+	// memory usage logging, nil logger when disabled
+	memStatsInterval time.Duration
+	memLog           *log.Logger
+
+	// fan transition events, nil when not configured
+	events *eventLog
+
+	// antifreeze heater, nil when not configured
+	heater *heater
+
+	// external enable input, nil when not configured, and the fan state
+	// held while it is disabled ("off", "on" or "hold")
+	enabled       func() bool
+	disabledState string
+
+	// automatic control paused; wake interrupts the poll sleep
+	paused atomic.Bool
+	wake   chan struct{}
+	// closed to stop the control loop and the deadman
+	quit chan struct{}
+
+	// end of the last loop iteration (unix nanoseconds), watched by the
+	// deadman; overridden is set when it drove the fan behind our back
+	heartbeat  atomic.Int64
+	overridden atomic.Bool
+	// serializes fan writes between the loop, the deadman and shutdown
+	fanMu sync.Mutex
+
+	// state carried between decisions, and the commanded fan state and time
+	// of the last write to the fan
+	controlState
+	running   bool
+	lastWrite time.Time
+	// air purge schedule
+	nextPurge  time.Time
+	purgeUntil time.Time
+
+	// reading and time of the last fan transition, for the transition log
+	changeTemp int
+	changeTime time.Time
+
+	// last temperature logged by logTemp
+	lastLogged int
+	tempLogged bool
+}
+
+// controlState is the state decide carries from one reading to the next
+type controlState struct {
+	// commanded speed
+	level int
+	// temperature driven speed, before overrides such as purges
+	demandLevel int
+	// iterations since the fan was last turned on
+	onCycles int
+	// speed change awaiting debounceCount agreeing readings
+	pendingLevel int
+	pendingCount int
+}
+
+// controlConfig holds the settings decide works with
+type controlConfig struct {
+	algorithm     Algorithm
+	minOnCycles   int
+	debounceCount int
+}
+
+// decide returns the state after a reading: the temperature driven speed,
+// debounced, and the speed to command, keeping a running fan on for
+// minOnCycles iterations. It does no I/O; overrides such as purges are up
+// to the caller.
+func decide(temp int, s controlState, cfg controlConfig) controlState {
+	next := debounce(cfg.algorithm.Decide(temp, s.demandLevel), s, cfg.debounceCount)
+	running := s.level > speedOff
+	if running {
+		next.onCycles++
+	}
+	on := holdOn(next.demandLevel > speedOff, running, next.onCycles, cfg.minOnCycles)
+	next.level = commandLevel(on, next.demandLevel, s.level)
+	if next.level > speedOff && !running {
+		next.onCycles = 0
+	}
+	return next
+}
+
+// debounce holds back a change of the temperature driven speed until
+// debounceCount consecutive readings agree on it
+func debounce(want int, s controlState, debounceCount int) controlState {
+	if debounceCount <= 1 || want == s.demandLevel {
+		s.demandLevel, s.pendingCount = want, 0
+		return s
+	}
+	if want != s.pendingLevel || s.pendingCount == 0 {
+		s.pendingLevel, s.pendingCount = want, 0
+	}
+	s.pendingCount++
+	if s.pendingCount >= debounceCount {
+		s.demandLevel, s.pendingCount = want, 0
+	}
+	return s
+}
+
+// fanDecision returns whether the fan should run at the given temperature.
+// Between the thresholds the current state is kept (hysteresis). When start
+// and stop are equal there is no hysteresis: on at start or above, off below.
+func fanDecision(temp int, start int, stop int, running bool) bool {
+	if temp >= start {
+		return true
+	}
+	if temp <= stop {
+		return false
+	}
+	return running
+}
+
+// holdOn returns whether the fan should run given the demand, keeping a
+// running fan on until it has run for minOnCycles iterations
+func holdOn(demand bool, running bool, onCycles int, minOnCycles int) bool {
+	return demand || (running && onCycles < minOnCycles)
+}
+
+// commandLevel returns the level to command: off when the fan should not
+// run, otherwise the demanded level, or the current one when the fan is
+// only held on
+func commandLevel(on bool, demandLevel int, level int) int {
+	switch {
+	case !on:
+		return speedOff
+	case demandLevel == speedOff:
+		return level
+	}
+	return demandLevel
+}
+
+// speedDecision is fanDecision for two speed fans: low from mid, high from
+// start, back to low below mid and off at stop
+func speedDecision(temp int, start int, mid int, stop int, level int) int {
+	switch {
+	case temp >= start:
+		return speedHigh
+	case temp <= stop:
+		return speedOff
+	case temp < mid && level == speedHigh:
+		return speedLow
+	case temp >= mid && level == speedOff:
+		return speedLow
+	}
+	return level
+}
+
+// setFan drives the fan to the given speed. The fan is only written on a
+// transition, or when the last write is older than the reassert interval.
+func (c *controller) setFan(level int, cpuTemp int, mode string) {
+	if level == c.level && !c.overridden.Swap(false) &&
+		(c.reassert <= 0 || time.Since(c.lastWrite) < c.reassert) {
+		return
+	}
+	if level != c.level {
+		if c.changeTime.IsZero() {
+			log.Printf("Fan: %s (%s: %v)\n", c.speedName(level), c.input, cpuTemp)
+		} else {
+			log.Printf("Fan: %s (%s: %v, temp_at_last_change: %v, delta: %+d, duration_since_last_change: %v)\n",
+				c.speedName(level), c.input, cpuTemp, c.changeTemp, cpuTemp-c.changeTemp, time.Since(c.changeTime).Round(time.Second))
+		}
+		c.changeTemp, c.changeTime = cpuTemp, time.Now()
+		if c.events != nil {
+			ev := event{Time: time.Now(), From: c.speedName(c.level), To: c.speedName(level), Input: c.input, Value: cpuTemp, Mode: mode}
+			if err := c.events.record(ev); err != nil {
+				log.Printf("Event log: %v\n", err)
+			}
+		}
+	}
+	c.forceFan(level)
+}
+
+// forceFan drives the fan to the given speed unconditionally
+func (c *controller) forceFan(level int) {
+	c.fanMu.Lock()
+	defer c.fanMu.Unlock()
+	if level > speedOff && !c.running {
+		c.onCycles = 0
+	}
+	switch {
+	case c.speed != nil:
+		c.speed.SetSpeed(level)
+	case level > speedOff:
+		c.fan.On()
+	default:
+		c.fan.Off()
+	}
+	c.running = level > speedOff
+	c.level = level
+	c.lastWrite = time.Now()
+}
+
+func (c *controller) speedName(level int) string {
+	if c.speed == nil {
+		return stateName(level > speedOff)
+	}
+	return speedNames[level]
+}
+
+// readTemp reads the temperature, rejecting implausible values like a
+// read error. The rejected value is only in the error, which the caller
+// logs.
+func (c *controller) readTemp() (int, error) {
+	cpuTemp, err := c.readSource()
+	if err != nil {
+		return 0, err
+	}
+	if cpuTemp < c.minValid || cpuTemp > c.maxValid {
+		return 0, &SensorError{Category: sensorOutOfRange, Source: c.thermal,
+			Err: fmt.Errorf("implausible temperature %v outside the valid range %v..%v", cpuTemp, c.minValid, c.maxValid)}
+	}
+	return cpuTemp, nil
+}
+
+// clamp limits a valid reading to the configured range. Unlike the
+// validity bounds in readTemp, the reading is used rather than rejected.
+func (c *controller) clamp(cpuTemp int) int {
+	clamped := cpuTemp
+	if c.clampMin != nil && clamped < *c.clampMin {
+		clamped = *c.clampMin
+	}
+	if c.clampMax != nil && clamped > *c.clampMax {
+		clamped = *c.clampMax
+	}
+	if clamped != cpuTemp && os.Getenv("MODE") == "debug" && !c.quiet(clamped) {
+		log.Printf("Clamped %v to %v\n", cpuTemp, clamped)
+	}
+	return clamped
+}
+
+type sourceResult struct {
+	temp int
+	err  error
+}
+
+// readSource reads the temperature source, giving up after readTimeout so
+// a wedged read cannot block the loop. An abandoned read is waited for by
+// the next call rather than piling up another one, and its stale result is
+// discarded for a fresh read.
+func (c *controller) readSource() (int, error) {
+	if c.readTimeout <= 0 {
+		return c.source()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.readTimeout)
+	defer cancel()
+	timedOut := func() (int, error) {
+		return 0, &SensorError{Category: sensorTimeout, Source: c.thermal, Err: ctx.Err()}
+	}
+
+	if c.pending != nil {
+		select {
+		case <-c.pending:
+			c.pending = nil
+		case <-ctx.Done():
+			return timedOut()
+		}
+	}
+	result := make(chan sourceResult, 1)
+	go func() {
+		temp, err := c.source()
+		result <- sourceResult{temp, err}
+	}()
+	select {
+	case r := <-result:
+		return r.temp, r.err
+	case <-ctx.Done():
+		c.pending = result
+		return timedOut()
+	}
+}
+
+// setInitialState drives the fan to an explicit state before the first
+// control decision. "auto" derives it from the first temperature read,
+// treating the fan as stopped; when read failures are tolerated and that
+// read fails, the fan starts on.
+func (c *controller) setInitialState(state string) error {
+	switch state {
+	case "on":
+		c.demandLevel = speedHigh
+		c.forceFan(speedHigh)
+	case "off":
+		c.forceFan(speedOff)
+	case "auto":
+		cpuTemp, err := c.readTemp()
+		if err != nil {
+			if !c.toleratesReadErrors() {
+				return err
+			}
+			// nothing to decide on: start on and let the loop escalate
+			log.Printf("Initial read failed, starting with the fan on: %v\n", err)
+			c.demandLevel = speedHigh
+			c.forceFan(speedHigh)
+			return nil
+		}
+		cpuTemp = c.clamp(cpuTemp)
+		c.demandLevel = c.algorithm.Decide(cpuTemp, speedOff)
+		c.forceFan(c.demandLevel)
+		c.changeTemp, c.changeTime = cpuTemp, time.Now()
+	}
+	return nil
+}
+
+// step runs a single iteration of the control logic: read the temperature,
+// decide and apply the fan state
+func (c *controller) step() (int, error) {
+	cpuTemp, err := c.readTemp()
+	if err != nil {
+		return 0, err
+	}
+	if c.heater != nil {
+		c.heater.update(cpuTemp)
+	}
+	cpuTemp = c.clamp(cpuTemp)
+	c.lastTemp = cpuTemp
+
+	mode := os.Getenv("MODE")
+	if mode == "debug" && !c.quiet(cpuTemp) {
+		log.Printf("%s: %v\n", c.input, cpuTemp)
+		c.fanMu.Lock()
+		log.Printf("Fan state: %v\n", c.fan.State())
+		c.fanMu.Unlock()
+	}
+
+	next := decide(cpuTemp, c.controlState, controlConfig{c.algorithm, c.minOnCycles, c.debounceCount})
+	c.demandLevel, c.pendingLevel, c.pendingCount = next.demandLevel, next.pendingLevel, next.pendingCount
+	if c.paused.Load() {
+		// keep reporting, but leave the fan alone
+		c.stats.update(cpuTemp, c.running, "paused")
+		c.logTemp(cpuTemp)
+		return cpuTemp, nil
+	}
+	if c.checkDisabled(cpuTemp) {
+		c.stats.update(cpuTemp, c.running, "disabled")
+		c.logTemp(cpuTemp)
+		return cpuTemp, nil
+	}
+	c.onCycles = next.onCycles
+	level, reason := next.level, "normal"
+	if c.purge(level) {
+		level, reason = speedHigh, "purge"
+	}
+	c.setFan(level, cpuTemp, reason)
+	c.stats.update(cpuTemp, c.running, reason)
+	c.logTemp(cpuTemp)
+	return cpuTemp, nil
+}
+
+// checkDisabled reads the external enable input and, while it is disabled,
+// holds the fan in disabledState. It reports whether control is disabled.
+func (c *controller) checkDisabled(cpuTemp int) bool {
+	if c.enabled == nil {
+		return false
+	}
+	if c.enabled() {
+		return false
+	}
+	switch c.disabledState {
+	case "on":
+		c.setFan(speedHigh, cpuTemp, "disabled")
+	case "off":
+		c.setFan(speedOff, cpuTemp, "disabled")
+	}
+	return true
+}
+
+// toleratesReadErrors reports whether read failures are escalated rather
+// than fatal
+func (c *controller) toleratesReadErrors() bool {
+	return c.holdErrors > 0 || c.failsafeErrors > 0
+}
+
+// readFailed escalates consecutive read failures: the fan state is held
+// from holdErrors failures (the first one when only failsafeErrors is set)
+// and forced on from failsafeErrors failures. Without either set, the first
+// failure is fatal and returned.
+func (c *controller) readFailed(err error) error {
+	if !c.toleratesReadErrors() {
+		return err
+	}
+	c.readErrors++
+	c.stats.readFailed()
+	log.Printf("Read failure %d: %v\n", c.readErrors, err)
+	holdAt := c.holdErrors
+	if holdAt <= 0 {
+		holdAt = 1
+	}
+	switch {
+	case c.failsafeErrors > 0 && c.readErrors >= c.failsafeErrors:
+		if c.readErrors == c.failsafeErrors {
+			log.Printf("Failsafe: %d consecutive read failures, forcing the fan on\n", c.readErrors)
+		}
+		c.setFan(speedHigh, c.lastTemp, "failsafe")
+		c.stats.setState(c.running, "failsafe")
+	case c.readErrors == holdAt:
+		log.Printf("Holding fan %s: %d consecutive read failures\n", c.speedName(c.level), c.readErrors)
+		c.stats.setState(c.running, "hold")
+	}
+	// the heater cannot be regulated without readings, so it is left off
+	if c.readErrors >= holdAt && c.heater != nil && c.heater.running {
+		c.heater.stop()
+		log.Print("Heater: off (read failures)\n")
+	}
+	return nil
+}
+
+// readRecovered resets the failure count after a successful read
+func (c *controller) readRecovered() {
+	if c.readErrors > 0 {
+		log.Printf("Reads recovered after %d failures\n", c.readErrors)
+		c.readErrors = 0
+	}
+}
+
+// togglePause pauses or resumes automatic control. On resume the loop is
+// woken up to apply the correct state right away.
+func (c *controller) togglePause() {
+	paused := !c.paused.Load()
+	c.paused.Store(paused)
+	if paused {
+		log.Print("Automatic control paused\n")
+		return
+	}
+	log.Print("Automatic control resumed\n")
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// purge reports whether a periodic full speed air purge is in progress,
+// starting one when it is due. A purge is skipped if the fan already runs
+// at full speed due to temperature; a fan at low speed still gets one.
+func (c *controller) purge(level int) bool {
+	if c.purgeInterval <= 0 {
+		return false
+	}
+	now := time.Now()
+	if c.nextPurge.IsZero() {
+		c.nextPurge = now.Add(c.purgeInterval)
+	}
+	if now.Before(c.purgeUntil) {
+		return true
+	}
+	if now.Before(c.nextPurge) {
+		return false
+	}
+	c.nextPurge = now.Add(c.purgeInterval)
+	if level == speedHigh {
+		log.Print("Air purge skipped: fan already at full speed\n")
+		return false
+	}
+	log.Printf("Air purge: running fan for %v\n", c.purgeDuration)
+	c.purgeUntil = now.Add(c.purgeDuration)
+	return true
+}
+
+// quiet reports whether routine logging is suppressed at this value.
+// Transitions are always logged.
+func (c *controller) quiet(cpuTemp int) bool {
+	return c.quietBelow != nil && cpuTemp < *c.quietBelow
+}
+
+// logTemp logs the temperature when it moved by more than logDelta since
+// the last logged value. Transitions are logged by setFan regardless.
+func (c *controller) logTemp(cpuTemp int) {
+	if c.logDelta <= 0 || c.quiet(cpuTemp) {
+		return
+	}
+	delta := cpuTemp - c.lastLogged
+	if delta < 0 {
+		delta = -delta
+	}
+	if c.tempLogged && delta <= c.logDelta {
+		return
+	}
+	log.Printf("%s: %v (fan: %s)\n", c.input, cpuTemp, stateName(c.running))
+	c.lastLogged = cpuTemp
+	c.tempLogged = true
+}
+
+// interval returns the poll interval in seconds for the current state:
+// idle when the fan is off and the temperature is at or below stop, active
+// otherwise, falling back to timeout for either
+func (c *controller) interval(cpuTemp int) int {
+	interval := c.timeout
+	if !c.running && cpuTemp <= c.stop {
+		if c.intervalIdle > 0 {
+			interval = c.intervalIdle
+		}
+	} else if c.intervalActive > 0 {
+		interval = c.intervalActive
+	}
+	if interval != c.lastInterval && os.Getenv("MODE") == "debug" && !c.quiet(cpuTemp) {
+		log.Printf("Poll interval: %vs\n", interval)
+	}
+	c.lastInterval = interval
+	return interval
+}
+
+// pollInterval returns the timeout randomized by up to +/- jitter seconds
+func pollInterval(timeout int, jitter int, rnd *rand.Rand) time.Duration {
+	interval := time.Duration(timeout) * time.Second
+	if jitter > 0 {
+		spread := time.Duration(jitter) * time.Second
+		interval += time.Duration(rnd.Int63n(int64(2*spread)+1)) - spread
+	}
+	if interval < 0 {
+		interval = 0
+	}
+	return interval
+}
+
+// run is the control loop. It returns nil once quit is closed, or the error
+// of a fatal read failure.
+func (c *controller) run() error {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	lastWriteLog := time.Now()
+	var lastMemStats time.Time
+	for {
+		cpuTemp, err := c.step()
+		if c.pair != nil {
+			c.fanMu.Lock()
+			c.pair.rotateIfDue()
+			c.fanMu.Unlock()
+		}
+		if err != nil {
+			if err := c.readFailed(err); err != nil {
+				return err
+			}
+			c.heartbeat.Store(time.Now().UnixNano())
+			select {
+			case <-time.After(pollInterval(c.timeout, c.jitter, rnd)):
+			case <-c.wake:
+			case <-c.quit:
+				return nil
+			}
+			continue
+		}
+		c.readRecovered()
+		c.heartbeat.Store(time.Now().UnixNano())
+
+		if c.alert != nil {
+			c.alert.check(cpuTemp)
+		}
+
+		if c.textfile != nil {
+			if err := c.textfile.write(c.stats, c.input); err != nil {
+				log.Printf("Unable to write textfile: %v\n", err)
+			}
+		}
+
+		if os.Getenv("MODE") == "debug" && time.Since(lastWriteLog) >= time.Hour {
+			log.Printf("Bytes written to disk: %s\n", diskWrites)
+			lastWriteLog = time.Now()
+		}
+
+		if c.memLog != nil && time.Since(lastMemStats) >= c.memStatsInterval {
+			memUsage(c.memLog)
+			lastMemStats = time.Now()
+		}
+
+		if c.ui != nil {
+			c.ui.update(c.stats.report(c.input, c.start, c.stop))
+		}
+
+		select {
+		case <-time.After(pollInterval(c.interval(cpuTemp), c.jitter, rnd)):
+		case <-c.wake:
+		case <-c.quit:
+			return nil
+		}
+	}
+}
+
+// deadman forces the fan on, bypassing the control loop, when the loop has
+// not completed an iteration within timeout
+func (c *controller) deadman(timeout time.Duration) {
+	c.heartbeat.Store(time.Now().UnixNano())
+	fired := false
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+		stalled := time.Since(time.Unix(0, c.heartbeat.Load()))
+		if stalled < timeout {
+			if fired {
+				log.Print("DEADMAN: control loop recovered\n")
+				fired = false
+			}
+			continue
+		}
+		if !fired {
+			log.Printf("DEADMAN: control loop stalled for %v, forcing fan on!\n", stalled.Round(time.Second))
+			c.overridden.Store(true)
+			c.fanMu.Lock()
+			c.fan.On()
+			c.fanMu.Unlock()
+			fired = true
+		}
+	}
+}
+
+func stateName(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestFanDecisionEqualThresholds(t *testing.T) {
+	const x = 60
+	for _, running := range []bool{false, true} {
+		if !fanDecision(x, x, x, running) {
+			t.Errorf("at %d (running %v): off, want on", x, running)
+		}
+		if !fanDecision(x+1, x, x, running) {
+			t.Errorf("at %d (running %v): off, want on", x+1, running)
+		}
+		if fanDecision(x-1, x, x, running) {
+			t.Errorf("at %d (running %v): on, want off", x-1, running)
+		}
+	}
+}
+
+func TestFanDecisionHysteresis(t *testing.T) {
+	tests := []struct {
+		temp    int
+		running bool
+		want    bool
+	}{
+		{68, false, true},
+		{64, false, false},
+		{64, true, true},
+		{60, true, false},
+		{59, false, false},
+	}
+	for _, tt := range tests {
+		if got := fanDecision(tt.temp, 68, 60, tt.running); got != tt.want {
+			t.Errorf("at %d (running %v): got %v, want %v", tt.temp, tt.running, got, tt.want)
+		}
+	}
+}
+
+// countingFan counts the writes to it
+type countingFan struct {
+	state  int
+	writes int
+}
+
+func (f *countingFan) On() {
+	f.writes++
+	f.state = 1
+}
+
+func (f *countingFan) Off() {
+	f.writes++
+	f.state = 0
+}
+
+func (f *countingFan) State() int {
+	return f.state
+}
+
+func TestSetFanWritesOnEdges(t *testing.T) {
+	fan := &countingFan{}
+	c := &controller{fan: fan}
+	levels := []int{speedOff, speedHigh, speedHigh, speedHigh, speedOff, speedOff, speedHigh}
+	for i, level := range levels {
+		c.setFan(level, 60, "normal")
+		if fan.State() != level/speedHigh {
+			t.Errorf("step %d: fan state %d after setting %s", i, fan.State(), speedNames[level])
+		}
+	}
+	// off to high, high to off, off to high
+	if fan.writes != 3 {
+		t.Errorf("got %d writes, want 3", fan.writes)
+	}
+}
+
+func TestSetFanReassert(t *testing.T) {
+	fan := &countingFan{}
+	c := &controller{fan: fan, reassert: time.Nanosecond}
+	for i := 0; i < 3; i++ {
+		c.setFan(speedHigh, 60, "normal")
+		time.Sleep(time.Millisecond)
+	}
+	if fan.writes != 3 {
+		t.Errorf("got %d writes, want 3 with reassert", fan.writes)
+	}
+}
+
+func TestReadSourceBlocked(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	c := &controller{readTimeout: 10 * time.Millisecond, thermal: "test", source: func() (int, error) {
+		calls <- struct{}{}
+		select {}
+	}}
+	for i := 0; i < 3; i++ {
+		_, err := c.readSource()
+		serr, ok := err.(*SensorError)
+		if !ok || serr.Category != sensorTimeout {
+			t.Fatalf("read %d: got %v, want a timeout", i, err)
+		}
+	}
+	// the wedged read is waited for, not started again
+	if n := len(calls); n != 1 {
+		t.Errorf("source called %d times, want 1", n)
+	}
+}
+
+func TestReadSourceDiscardsStale(t *testing.T) {
+	release := make(chan struct{})
+	reads := 0
+	c := &controller{readTimeout: 50 * time.Millisecond, thermal: "test", source: func() (int, error) {
+		reads++
+		if reads == 1 {
+			<-release
+			return 40, nil
+		}
+		return 50, nil
+	}}
+	if _, err := c.readSource(); err == nil {
+		t.Fatal("wedged read did not time out")
+	}
+	close(release)
+	temp, err := c.readSource()
+	if err != nil || temp != 50 {
+		t.Errorf("got %v (%v), want the fresh reading 50", temp, err)
+	}
+}
+
+// decideRun feeds temps through decide from a stopped fan and calls check
+// with the state before and after each reading
+func decideRun(temps []int8, cfg controlConfig, check func(temp int, prev, next controlState) bool) bool {
+	var s controlState
+	for _, t := range temps {
+		next := decide(int(t), s, cfg)
+		if !check(int(t), s, next) {
+			return false
+		}
+		s = next
+	}
+	return true
+}
+
+// testConfigs returns a hysteresis and a two speed configuration for
+// thresholds derived from arbitrary values, and the thresholds
+func testConfigs(a, b, m int8, minOn, debounce uint8) ([]controlConfig, int, int) {
+	start, stop := int(a), int(b)
+	if stop > start {
+		start, stop = stop, start
+	}
+	mid := stop + (start-stop)*int(uint8(m))/255
+	var cfgs []controlConfig
+	for _, alg := range []Algorithm{hysteresis{start: start, stop: stop}, twoSpeed{start: start, mid: mid, stop: stop}} {
+		cfgs = append(cfgs, controlConfig{algorithm: alg, minOnCycles: int(minOn % 8), debounceCount: int(debounce % 5)})
+	}
+	return cfgs, start, stop
+}
+
+func TestDecideNeverOffAtStart(t *testing.T) {
+	f := func(temps []int8, a, b, m int8, minOn uint8) bool {
+		cfgs, start, _ := testConfigs(a, b, m, minOn, 1)
+		for _, cfg := range cfgs {
+			ok := decideRun(temps, cfg, func(temp int, prev, next controlState) bool {
+				return temp < start || next.level == speedHigh
+			})
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecideNeverOnAtStop(t *testing.T) {
+	f := func(temps []int8, a, b, m int8, minOn, debounce uint8) bool {
+		cfgs, start, stop := testConfigs(a, b, m, minOn, debounce)
+		for _, cfg := range cfgs {
+			ok := decideRun(temps, cfg, func(temp int, prev, next controlState) bool {
+				// equal thresholds switch on at start
+				return temp > stop || temp >= start || prev.level > speedOff || next.level == speedOff
+			})
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecideMinOnCycles(t *testing.T) {
+	f := func(temps []int8, a, b, m int8, minOn, debounce uint8) bool {
+		cfgs, _, _ := testConfigs(a, b, m, minOn, debounce)
+		for _, cfg := range cfgs {
+			ran := 0
+			ok := decideRun(temps, cfg, func(temp int, prev, next controlState) bool {
+				if prev.level == speedOff {
+					ran = 0
+				} else {
+					ran++
+				}
+				return next.level > speedOff || prev.level == speedOff || ran >= cfg.minOnCycles
+			})
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecideLevels(t *testing.T) {
+	f := func(temps []int8, a, b, m int8, minOn, debounce uint8) bool {
+		cfgs, _, _ := testConfigs(a, b, m, minOn, debounce)
+		cfg := cfgs[1]
+		return decideRun(temps, cfg, func(temp int, prev, next controlState) bool {
+			return next.level >= speedOff && next.level <= speedHigh &&
+				next.demandLevel >= speedOff && next.demandLevel <= speedHigh
+		})
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDebounceOscillating(t *testing.T) {
+	cfg := controlConfig{algorithm: hysteresis{start: 68, stop: 60}, debounceCount: 3}
+	var s controlState
+	// readings flipping across both thresholds never agree long enough
+	for i, temp := range []int{70, 55, 70, 70, 55, 70, 55, 70, 70, 50} {
+		s = decide(temp, s, cfg)
+		if s.level != speedOff {
+			t.Fatalf("reading %d (%d): fan switched to %s", i, temp, speedNames[s.level])
+		}
+	}
+	// three agreeing readings switch it
+	for i, want := range []int{speedOff, speedOff, speedHigh} {
+		s = decide(70, s, cfg)
+		if s.level != want {
+			t.Fatalf("agreeing reading %d: got %s, want %s", i, speedNames[s.level], speedNames[want])
+		}
+	}
+	// and the same holds on the way back
+	for i, temp := range []int{55, 70, 55, 55, 70, 55} {
+		s = decide(temp, s, cfg)
+		if s.level != speedHigh {
+			t.Fatalf("reading %d (%d): fan switched to %s", i, temp, speedNames[s.level])
+		}
+	}
+}
+
+func TestDebounceDisabled(t *testing.T) {
+	for _, count := range []int{0, 1} {
+		var s controlState
+		for i, want := range []int{speedHigh, speedOff, speedHigh} {
+			s = debounce(want, s, count)
+			if s.demandLevel != want || s.pendingCount != 0 {
+				t.Errorf("count %d, step %d: got %s pending %d, want %s", count, i, speedNames[s.demandLevel], s.pendingCount, speedNames[want])
+			}
+		}
+	}
+}
+
+func TestPurgeSkippedAtHigh(t *testing.T) {
+	for level, want := range map[int]bool{speedOff: true, speedLow: true, speedHigh: false} {
+		c := &controller{purgeInterval: time.Hour, purgeDuration: time.Minute, nextPurge: time.Now().Add(-time.Second)}
+		if got := c.purge(level); got != want {
+			t.Errorf("purge at %s: got %v, want %v", speedNames[level], got, want)
+		}
+		if !c.nextPurge.After(time.Now()) {
+			t.Errorf("purge at %s: next purge not rescheduled", speedNames[level])
+		}
+	}
+}
+
+func TestReadFailedEscalation(t *testing.T) {
+	c := &controller{fan: &memFan{}, input: "test", stats: newStats(false), holdErrors: 2, failsafeErrors: 4}
+	failed := errors.New("read failed")
+	for i, mode := range []string{"normal", "hold", "hold", "failsafe", "failsafe"} {
+		if err := c.readFailed(failed); err != nil {
+			t.Fatalf("failure %d: %v", i+1, err)
+		}
+		if c.stats.mode != mode {
+			t.Errorf("failure %d: mode %s, want %s", i+1, c.stats.mode, mode)
+		}
+	}
+	if c.level != speedHigh {
+		t.Errorf("failsafe left the fan %s", speedNames[c.level])
+	}
+
+	c = &controller{fan: &memFan{}}
+	if err := c.readFailed(failed); err != failed {
+		t.Errorf("without escalation: got %v, want the read error", err)
+	}
+}
+
+func TestInitialReadFailure(t *testing.T) {
+	failing := func() (int, error) { return 0, errors.New("read failed") }
+	c := &controller{fan: &memFan{}, input: "test", source: failing}
+	if err := c.setInitialState("auto"); err == nil {
+		t.Error("failed first read accepted without escalation")
+	}
+	c = &controller{fan: &memFan{}, input: "test", source: failing, failsafeErrors: 3}
+	if err := c.setInitialState("auto"); err != nil || c.level != speedHigh {
+		t.Errorf("got %v with the fan %s, want the fan on", err, speedNames[c.level])
+	}
+}
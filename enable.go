@@ -0,0 +1,87 @@
+package main
+
+// External enable input
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// how often the edge detect status of the enable pin is checked
+const enableCheckInterval = 10 * time.Millisecond
+
+// enableInput follows the enable pin through edge detection in its own
+// goroutine, so that a switch is honoured without waiting for the next poll
+type enableInput struct {
+	pin      rpio.Pin
+	debounce time.Duration
+	enabled  atomic.Bool
+	// wake interrupts the control loop sleep on a change
+	wake chan<- struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// watchEnable configures pin as pulled up input, enabled while high, and
+// starts following it
+func watchEnable(pin rpio.Pin, debounce time.Duration, wake chan<- struct{}) *enableInput {
+	e := &enableInput{pin: pin, debounce: debounce, wake: wake, quit: make(chan struct{}), done: make(chan struct{})}
+	pin.Input()
+	pin.PullUp()
+	e.enabled.Store(pinState(pin) == 1)
+	log.Printf("Enable input GPIO %d: %s\n", pin, enableName(e.enabled.Load()))
+	pin.Detect(rpio.AnyEdge)
+	go e.watch()
+	return e
+}
+
+func (e *enableInput) watch() {
+	defer close(e.done)
+	ticker := time.NewTicker(enableCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.quit:
+			return
+		case <-ticker.C:
+		}
+		if !e.pin.EdgeDetected() {
+			continue
+		}
+		// let a mechanical switch settle, then drop the edges of its chatter
+		select {
+		case <-e.quit:
+			return
+		case <-time.After(e.debounce):
+		}
+		e.pin.EdgeDetected()
+		enabled := pinState(e.pin) == 1
+		if enabled == e.enabled.Load() {
+			continue
+		}
+		e.enabled.Store(enabled)
+		log.Printf("Enable input GPIO %d: %s\n", e.pin, enableName(enabled))
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stop ends the watch and disables edge detection. It must be called before
+// GPIO memory is released.
+func (e *enableInput) stop() {
+	close(e.quit)
+	<-e.done
+	e.pin.Detect(rpio.NoEdge)
+}
+
+func enableName(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
@@ -0,0 +1,47 @@
+package main
+
+// Fan transition events
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// event is one fan transition, written as a JSON line
+type event struct {
+	Time  time.Time `json:"time"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Input string    `json:"input"`
+	Value int       `json:"value"`
+	Mode  string    `json:"mode"`
+}
+
+// eventLog appends fan transitions to a JSON lines file, separately from
+// the general log
+type eventLog struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{file: f, enc: json.NewEncoder(diskWrites.writer("events", f))}, nil
+}
+
+// record writes the event and syncs it to disk, so that the record
+// survives a power loss right after the transition
+func (e *eventLog) record(ev event) error {
+	if err := e.enc.Encode(ev); err != nil {
+		return err
+	}
+	return e.file.Sync()
+}
+
+func (e *eventLog) close() error {
+	return e.file.Close()
+}
@@ -0,0 +1,47 @@
+package main
+
+// expvar export
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// expvarHandler serves the control loop figures under /debug/vars in the
+// expvar format. Only the "pifan" variable is served: the default expvar
+// handler also exports the command line, which may hold the SMTP password.
+func expvarHandler(s *stats, input string) http.Handler {
+	pifan := expvar.Func(func() interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return map[string]interface{}{
+			"input":       input,
+			"value":       s.temp,
+			"running":     s.running,
+			"mode":        s.mode,
+			"transitions": s.transitions,
+			"read_errors": s.readErrors,
+		}
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n%q: %s\n}\n", "pifan", pifan.String())
+	})
+	return mux
+}
+
+// publishExpvar serves expvarHandler on addr until the returned server is
+// shut down
+func publishExpvar(addr string, s *stats, input string) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: expvarHandler(s, input)}
+	go func() {
+		log.Printf("Serving expvar on %s/debug/vars\n", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("expvar server: %v\n", err)
+		}
+	}()
+	return srv
+}
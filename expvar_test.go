@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpvarHandlerOnlyPifan(t *testing.T) {
+	rec := httptest.NewRecorder()
+	expvarHandler(newStats(true), "temp").ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+
+	var vars map[string]map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if len(vars) != 1 || vars["pifan"] == nil {
+		t.Fatalf("got variables %v, want only pifan", vars)
+	}
+	if vars["pifan"]["running"] != true || vars["pifan"]["input"] != "temp" {
+		t.Errorf("got %v", vars["pifan"])
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+// Fan outputs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// Fan is a cooling device that can be switched on and off
+type Fan interface {
+	On()
+	Off()
+	// State returns 1 when the fan is running, 0 otherwise
+	State() int
+}
+
+// number of extra writes when a verified pin does not read back as written
+const verifyRetries = 3
+
+// writePin drives the pin high or low. With verify, the pin is read back
+// and written again while it does not match, which catches writes that
+// silently did not take effect.
+func writePin(pin rpio.Pin, on bool, verify bool) {
+	want := 0
+	if on {
+		fanOn(pin)
+		want = 1
+	} else {
+		fanOff(pin)
+	}
+	if !verify {
+		return
+	}
+	for retry := 1; pinState(pin) != want; retry++ {
+		if retry > verifyRetries {
+			log.Printf("GPIO %d still reads %d after %d retries\n", pin, pinState(pin), verifyRetries)
+			return
+		}
+		log.Printf("GPIO %d reads %d after writing %d, retrying\n", pin, pinState(pin), want)
+		if on {
+			fanOn(pin)
+		} else {
+			fanOff(pin)
+		}
+	}
+}
+
+// gpioFan drives the fan through a GPIO pin
+type gpioFan struct {
+	pin    rpio.Pin
+	verify bool
+}
+
+func (f *gpioFan) On() {
+	writePin(f.pin, true, f.verify)
+}
+
+func (f *gpioFan) Off() {
+	writePin(f.pin, false, f.verify)
+}
+
+func (f *gpioFan) State() int {
+	return pinState(f.pin)
+}
+
+// fan speeds
+const (
+	speedOff = iota
+	speedLow
+	speedHigh
+)
+
+var speedNames = []string{"off", "low", "high"}
+
+// speedFan is a fan with a low and a high speed
+type speedFan interface {
+	Fan
+	SetSpeed(level int)
+}
+
+// twoSpeedFan drives a two speed fan through one relay pin per speed. At
+// most one pin is high at any time: the active pin is released before the
+// other one is engaged.
+type twoSpeedFan struct {
+	low    rpio.Pin
+	high   rpio.Pin
+	verify bool
+}
+
+func (f *twoSpeedFan) On() {
+	f.SetSpeed(speedHigh)
+}
+
+func (f *twoSpeedFan) Off() {
+	f.SetSpeed(speedOff)
+}
+
+func (f *twoSpeedFan) State() int {
+	if pinState(f.low) == 1 || pinState(f.high) == 1 {
+		return 1
+	}
+	return 0
+}
+
+func (f *twoSpeedFan) SetSpeed(level int) {
+	switch level {
+	case speedOff:
+		writePin(f.low, false, f.verify)
+		writePin(f.high, false, f.verify)
+	case speedLow:
+		writePin(f.high, false, f.verify)
+		writePin(f.low, true, f.verify)
+	case speedHigh:
+		writePin(f.low, false, f.verify)
+		writePin(f.high, true, f.verify)
+	}
+}
+
+// fanPair drives two fans that can each handle the normal load. At low
+// speed a single fan runs, and the running fan alternates once the active
+// one has run alone for the rotation interval, to even out wear. At high
+// speed both run.
+type fanPair struct {
+	pins   [2]rpio.Pin
+	rotate time.Duration
+	verify bool
+
+	// guards the fields below, also read from the snapshot signal handler
+	mu sync.Mutex
+	// index of the fan used at low speed, the time it has run alone since
+	// it took over, and the start of the current low speed run
+	active  int
+	runtime time.Duration
+	since   time.Time
+	level   int
+}
+
+func (f *fanPair) On() {
+	f.SetSpeed(speedHigh)
+}
+
+func (f *fanPair) Off() {
+	f.SetSpeed(speedOff)
+}
+
+func (f *fanPair) State() int {
+	if pinState(f.pins[0]) == 1 || pinState(f.pins[1]) == 1 {
+		return 1
+	}
+	return 0
+}
+
+// SetSpeed engages the fans for the level
+func (f *fanPair) SetSpeed(level int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.account()
+	f.write(level)
+	f.level = level
+}
+
+// rotateIfDue hands low speed over to the other fan once the active one has
+// run alone for the rotation interval. It is called from the control loop,
+// independently of fan writes.
+func (f *fanPair) rotateIfDue() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.account()
+	if f.level != speedLow || f.rotate <= 0 || f.runtime < f.rotate {
+		return
+	}
+	f.active = 1 - f.active
+	f.runtime = 0
+	log.Printf("Fan pair: rotating to GPIO %d\n", f.pins[f.active])
+	f.write(speedLow)
+}
+
+// account adds the time the active fan has run alone since the last call
+func (f *fanPair) account() {
+	now := time.Now()
+	if f.level == speedLow {
+		f.runtime += now.Sub(f.since)
+	}
+	f.since = now
+}
+
+func (f *fanPair) write(level int) {
+	switch level {
+	case speedOff:
+		writePin(f.pins[0], false, f.verify)
+		writePin(f.pins[1], false, f.verify)
+	case speedLow:
+		// engage the active fan before releasing the other one
+		writePin(f.pins[f.active], true, f.verify)
+		writePin(f.pins[1-f.active], false, f.verify)
+	case speedHigh:
+		writePin(f.pins[0], true, f.verify)
+		writePin(f.pins[1], true, f.verify)
+	}
+}
+
+// activePins describes the fans currently running
+func (f *fanPair) activePins() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch f.level {
+	case speedLow:
+		return fmt.Sprintf("GPIO %d", f.pins[f.active])
+	case speedHigh:
+		return fmt.Sprintf("GPIO %d and %d", f.pins[0], f.pins[1])
+	}
+	return "none"
+}
+
+// memFan is a fan that only exists in memory, used when simulating
+type memFan struct {
+	// read by the simulator from the sensor read goroutine
+	state atomic.Int32
+}
+
+func (f *memFan) On() {
+	f.state.Store(1)
+}
+
+func (f *memFan) Off() {
+	f.state.Store(0)
+}
+
+func (f *memFan) State() int {
+	return int(f.state.Load())
+}
+
+// cmdFan drives the fan through an external command, invoked with the
+// new state ("on" or "off") as its last argument. The command is split on
+// white space, without shell quoting. The state only changes when the
+// command succeeds.
+type cmdFan struct {
+	command string
+	timeout time.Duration
+	state   int
+}
+
+func (f *cmdFan) On() {
+	if f.run("on") {
+		f.state = 1
+	}
+}
+
+func (f *cmdFan) Off() {
+	if f.run("off") {
+		f.state = 0
+	}
+}
+
+func (f *cmdFan) State() int {
+	return f.state
+}
+
+// run invokes the command and reports whether it succeeded
+func (f *cmdFan) run(state string) bool {
+	args := strings.Fields(f.command)
+	if len(args) == 0 {
+		log.Print("Fan command is empty\n")
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, args[0], append(args[1:], state)...).CombinedOutput()
+	if err != nil {
+		log.Printf("Fan command '%s %s' failed: %v: %s\n", f.command, state, err, out)
+		return false
+	}
+	return true
+}
+
+// multiFan applies every action to all of its fans
+type multiFan []Fan
+
+func (m multiFan) On() {
+	for _, f := range m {
+		f.On()
+	}
+}
+
+func (m multiFan) Off() {
+	for _, f := range m {
+		f.Off()
+	}
+}
+
+// State returns 1 when any of the fans is running
+func (m multiFan) State() int {
+	for _, f := range m {
+		if f.State() == 1 {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCmdFanArguments(t *testing.T) {
+	// 'test on = <state>' only succeeds for "on", so the arguments must be
+	// passed separately and the state appended
+	f := &cmdFan{command: "test on =", timeout: 5 * time.Second}
+	f.On()
+	if f.State() != 1 {
+		t.Fatal("successful command did not turn the fan on")
+	}
+	f.Off()
+	if f.State() != 1 {
+		t.Error("failed command changed the state")
+	}
+}
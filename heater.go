@@ -0,0 +1,40 @@
+package main
+
+// Antifreeze heater output
+
+import (
+	"log"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// heater drives a second GPIO output that turns a heater on at or below
+// on and off again at or above off, independently of the fan
+type heater struct {
+	pin     rpio.Pin
+	on      int
+	off     int
+	running bool
+}
+
+// update applies the fan hysteresis mirrored: the heater starts when the
+// temperature falls to on and stops when it rises to off
+func (h *heater) update(temp int) {
+	running := fanDecision(-temp, -h.on, -h.off, h.running)
+	if running == h.running {
+		return
+	}
+	h.running = running
+	if running {
+		fanOn(h.pin)
+	} else {
+		fanOff(h.pin)
+	}
+	log.Printf("Heater: %s (temperature: %v)\n", stateName(running), temp)
+}
+
+// stop turns the heater off, the safe state on shutdown
+func (h *heater) stop() {
+	fanOff(h.pin)
+	h.running = false
+}
@@ -0,0 +1,76 @@
+package main
+
+// hwmon sensor lookup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const hwmonRoot = "/sys/class/hwmon"
+
+// resolveHwmon finds the input file of an hwmon sensor given as
+// "chip:label", e.g. "cpu_thermal:temp1". The chip is matched against the
+// hwmonN/name files and the label against the tempX_label files, falling
+// back to the tempX channel name, so the result survives renumbering of
+// hwmon devices across reboots.
+func resolveHwmon(spec string) (string, error) {
+	chip, label, ok := strings.Cut(spec, ":")
+	if !ok || chip == "" || label == "" {
+		return "", fmt.Errorf("invalid hwmon sensor %q (expected 'chip:label')", spec)
+	}
+
+	devices, err := filepath.Glob(filepath.Join(hwmonRoot, "hwmon*"))
+	if err != nil {
+		return "", err
+	}
+	for _, dev := range devices {
+		if readTrimmed(filepath.Join(dev, "name")) != chip {
+			continue
+		}
+		labels, _ := filepath.Glob(filepath.Join(dev, "temp*_label"))
+		for _, l := range labels {
+			if readTrimmed(l) == label {
+				return strings.TrimSuffix(l, "_label") + "_input", nil
+			}
+		}
+		input := filepath.Join(dev, label+"_input")
+		if _, err := os.Stat(input); err == nil {
+			return input, nil
+		}
+	}
+	return "", fmt.Errorf("hwmon sensor %q not found under %s", spec, hwmonRoot)
+}
+
+func readTrimmed(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// hwmonSource reads an hwmon sensor, resolving its input file again when a
+// read fails in case the device reappeared under a different hwmonN
+type hwmonSource struct {
+	spec     string
+	path     string
+	rounding string
+}
+
+func (h *hwmonSource) read() (int, error) {
+	temp, err := currentTemp(h.path, h.rounding)
+	if err == nil {
+		return temp, nil
+	}
+	if path, rerr := resolveHwmon(h.spec); rerr == nil && path != h.path {
+		log.Printf("hwmon sensor %s re-resolved: %s\n", h.spec, path)
+		h.path = path
+		return currentTemp(h.path, h.rounding)
+	}
+	return 0, err
+}
@@ -0,0 +1,60 @@
+package main
+
+// I2C temperature sensors
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ioctl selecting the slave address of an I2C bus device
+const i2cSlave = 0x0703
+
+// i2cSensor reads an LM75 compatible sensor on an I2C bus. The temperature
+// register is a left aligned two's complement value whose resolution
+// depends on the sensor type.
+type i2cSensor struct {
+	bus      int
+	addr     int
+	kind     string
+	rounding string
+}
+
+// resolution in bits after the binary point, per sensor type
+var i2cSensorBits = map[string]uint{
+	"lm75":   1, // 9 bit, 0.5 degree
+	"lm75b":  3, // 11 bit, 0.125 degree
+	"tmp102": 4, // 12 bit, 0.0625 degree
+}
+
+func (s *i2cSensor) path() string {
+	return fmt.Sprintf("/dev/i2c-%d", s.bus)
+}
+
+func (s *i2cSensor) String() string {
+	return fmt.Sprintf("%s@0x%02x", s.path(), s.addr)
+}
+
+func (s *i2cSensor) read() (int, error) {
+	f, err := os.OpenFile(s.path(), os.O_RDWR, 0)
+	if err != nil {
+		return 0, &SensorError{Category: sensorNotFound, Source: s.String(), Err: err}
+	}
+	defer f.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), i2cSlave, uintptr(s.addr)); errno != 0 {
+		return 0, &SensorError{Category: sensorReadError, Source: s.String(), Err: errno}
+	}
+	// select the temperature register, then read it
+	if _, err := f.Write([]byte{0x00}); err != nil {
+		return 0, &SensorError{Category: sensorReadError, Source: s.String(), Err: err}
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, &SensorError{Category: sensorReadError, Source: s.String(), Err: err}
+	}
+	bits := i2cSensorBits[s.kind]
+	raw := int64(int16(uint16(buf[0])<<8|uint16(buf[1]))) >> (8 - bits)
+	return scaleTemp(raw*1000/(1<<bits), s.rounding), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+// Load average source
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const loadavgPath = "/proc/loadavg"
+
+// readLoad returns the 1 minute load average as a percentage of the CPU
+// capacity, so that it can drive the fan through the same thresholds as a
+// temperature
+func readLoad() (int, error) {
+	content, err := ioutil.ReadFile(loadavgPath)
+	if err != nil {
+		return 0, &SensorError{Category: sensorReadError, Source: loadavgPath, Err: err}
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, &SensorError{Category: sensorParseError, Source: loadavgPath, Err: fmt.Errorf("empty content")}
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, &SensorError{Category: sensorParseError, Source: loadavgPath, Err: err}
+	}
+	return int(load * 100 / float64(runtime.NumCPU())), nil
+}
@@ -4,10 +4,15 @@ package main
 // Start / Stop fan according to temperature threshold
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -15,38 +20,90 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
 
 	"github.com/stianeikeland/go-rpio/v4"
 )
 
-func memUsage() {
-	var mem runtime.MemStats
-	runtime.ReadMemStats(&mem)
-	allocatedTotal := mem.TotalAlloc / 1024 / 1024
-	allocated := mem.Alloc / 1024 / 1024
-	allocatedBySystem := mem.Sys / 1024 / 1024
-	log.Printf("Memory usage (allocated): %v\n", allocated)
-	log.Printf("Memory usage (total allocated): %v\n", allocatedTotal)
-	log.Printf("Memory usage (allocated by system): %v\n", allocatedBySystem)
+// memStats is reused across memUsage calls to avoid an allocation each time
+var memStats runtime.MemStats
+
+// memUsage logs the memory usage in MiB. ReadMemStats stops the world, so
+// it only runs every -mem-stats-interval.
+func memUsage(logger *log.Logger) {
+	runtime.ReadMemStats(&memStats)
+	allocatedTotal := memStats.TotalAlloc / 1024 / 1024
+	allocated := memStats.Alloc / 1024 / 1024
+	allocatedBySystem := memStats.Sys / 1024 / 1024
+	logger.Printf("Memory usage (allocated): %v\n", allocated)
+	logger.Printf("Memory usage (total allocated): %v\n", allocatedTotal)
+	logger.Printf("Memory usage (allocated by system): %v\n", allocatedBySystem)
 }
 
-func currentTemp(source string) (int, error) {
+// maximum number of bytes of sensor content quoted in error messages
+const maxQuotedContent = 32
+
+func currentTemp(source string, rounding string) (int, error) {
 	rawTempUnformatted, err := ioutil.ReadFile(source)
 	if err != nil {
-		log.Fatal(err)
-		return 0, err
+		category := sensorReadError
+		if os.IsNotExist(err) {
+			category = sensorNotFound
+		}
+		return 0, &SensorError{Category: category, Source: source, Err: err}
 	}
-	rawTempFormatted := strings.Replace(string(rawTempUnformatted), "\n", "", -1)
-	sysTemp, err := strconv.Atoi(string(rawTempFormatted))
+	rawTempFormatted := strings.TrimSpace(string(rawTempUnformatted))
+	// drop a trailing unit suffix (e.g. "45000 mC") if present
+	rawTempFormatted = strings.TrimRightFunc(rawTempFormatted, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	sysTemp, err := strconv.ParseInt(rawTempFormatted, 10, 64)
 	if err != nil {
-		log.Fatal(err)
-		return 0, err
+		return 0, &SensorError{Category: sensorParseError, Source: source,
+			Err: fmt.Errorf("unable to parse content %q: %v", truncate(string(rawTempUnformatted), maxQuotedContent), err)}
 	}
-	humanReadable := sysTemp / 1000
+	humanReadable := scaleTemp(sysTemp, rounding)
 	return humanReadable, nil
 }
 
+// scaleTemp converts millidegrees to degrees: "trunc" drops the fraction,
+// "round" rounds to the nearest degree and "ceil" rounds up, which starts
+// the fan up to a degree earlier
+func scaleTemp(milli int64, rounding string) int {
+	switch rounding {
+	case "round":
+		return int(math.Round(float64(milli) / 1000))
+	case "ceil":
+		return int(math.Ceil(float64(milli) / 1000))
+	}
+	return int(milli / 1000)
+}
+
+// how long shutdown waits for the control loop to finish its iteration
+const shutdownTimeout = 15 * time.Second
+
+// goroutineStacks returns the stacks of all goroutines, growing the buffer
+// until they fit
+func goroutineStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
 func fanOn(pin rpio.Pin) {
 	pin.Write(1)
 }
@@ -55,63 +112,373 @@ func fanOff(pin rpio.Pin) {
 	pin.Write(0)
 }
 
+// setupPin configures a GPIO pin as output and drives it to a defined
+// level before the first decision, instead of keeping whatever the pin was
+// left at
+func setupPin(gpio int, pull string, high bool) rpio.Pin {
+	pin := rpio.Pin(gpio)
+	switch pull {
+	case "up":
+		pin.PullUp()
+	case "down":
+		pin.PullDown()
+	case "off":
+		pin.PullOff()
+	}
+	pin.Output()
+	log.Printf("GPIO %d initial state: %v\n", gpio, pinState(pin))
+	if high {
+		fanOn(pin)
+	} else {
+		fanOff(pin)
+	}
+	return pin
+}
+
 func pinState(pin rpio.Pin) int {
 	state := pin.Read()
 	return int(state)
 }
 
-func fanControl(start int, stop int, timeout int, thermal string, pin rpio.Pin) {
-	for {
-		cpuTemp, err := currentTemp(thermal)
-		if err != nil {
-			log.Fatal(err)
+// config holds the command line settings checked by validateConfig
+type config struct {
+	start, stop, mid    int
+	loadStart, loadStop int
+	minValid, maxValid  int
+	// clamp bounds, nil when not set
+	clampMin, clampMax *int
+
+	timeout, intervalIdle, intervalActive, jitter int
+	readTimeout, fanCmdTimeout, deadmanTimeout    int
+	holdErrors, failsafeErrors                    int
+
+	initialState, outPull, dumpSignal, quitAction, shutdownFan string
+	disabledState, rounding, controlSource, report             string
+
+	// thermal is set when '-thermal' was given explicitly
+	thermal     bool
+	thermalType string
+	hwmon       string
+	i2cBus      int
+	i2cAddr     int
+	i2cType     string
+
+	gpioHigh, gpioPair, enableGPIO, heatGPIO int
+	heatOn, heatOff                          int
+	outputs, fanCmd                          string
+	noGPIO, simulate                         bool
+	simCooling, simFanCooling                float64
+
+	alertTemp  int
+	syslog     string
+	syslogOnly bool
+}
+
+// thresholds returns the start and stop thresholds the control algorithm
+// works on: the load ones when controlling on load
+func (c config) thresholds() (int, int) {
+	if c.controlSource == "load" {
+		return c.loadStart, c.loadStop
+	}
+	return c.start, c.stop
+}
+
+// validateConfig checks the command line settings for consistency
+func validateConfig(c config) error {
+	if c.stop > c.start {
+		return fmt.Errorf("stop threshold (%d) must not be above start threshold (%d)", c.stop, c.start)
+	}
+	if c.minValid >= c.maxValid {
+		return fmt.Errorf("minimum valid temperature (%d) must be below maximum valid temperature (%d)", c.minValid, c.maxValid)
+	}
+	if c.clampMin != nil && c.clampMax != nil && *c.clampMin > *c.clampMax {
+		return fmt.Errorf("clamp minimum (%d) must not be above clamp maximum (%d)", *c.clampMin, *c.clampMax)
+	}
+	if c.controlSource == "load" && c.loadStop > c.loadStart {
+		return fmt.Errorf("load stop threshold (%d) must not be above load start threshold (%d)", c.loadStop, c.loadStart)
+	}
+
+	// a zero timeout would poll as fast as possible and heat the Pi itself,
+	// and so would a jitter that reaches the shortest interval
+	if c.timeout <= 0 {
+		return fmt.Errorf("timeout (%d) must be positive", c.timeout)
+	}
+	if c.intervalIdle < 0 || c.intervalActive < 0 {
+		return fmt.Errorf("idle and active intervals (%d, %d) must not be negative", c.intervalIdle, c.intervalActive)
+	}
+	shortest, longest := c.timeout, c.timeout
+	for _, interval := range []int{c.intervalIdle, c.intervalActive} {
+		if interval > 0 && interval < shortest {
+			shortest = interval
+		}
+		if interval > longest {
+			longest = interval
 		}
+	}
+	if c.jitter < 0 || c.jitter >= shortest {
+		return fmt.Errorf("jitter (%d) must not be negative and must be below the shortest interval (%d)", c.jitter, shortest)
+	}
+	// a healthy iteration may wait out a slow read and fan command on top
+	// of the poll interval
+	cycle := longest + c.jitter + c.readTimeout
+	if c.fanCmd != "" {
+		cycle += c.fanCmdTimeout
+	}
+	if c.deadmanTimeout > 0 && c.deadmanTimeout <= cycle {
+		return fmt.Errorf("deadman timeout (%d) must be longer than the poll interval plus read and fan command timeouts (%d)", c.deadmanTimeout, cycle)
+	}
+
+	if c.holdErrors < 0 || c.failsafeErrors < 0 {
+		return fmt.Errorf("'-hold-errors' and '-failsafe-errors' must not be negative")
+	}
+	if c.holdErrors > 0 && c.failsafeErrors > 0 && c.holdErrors > c.failsafeErrors {
+		return fmt.Errorf("hold errors (%d) must not be above failsafe errors (%d)", c.holdErrors, c.failsafeErrors)
+	}
 
-		mode := os.Getenv("MODE")
-		if mode == "debug" {
-			memUsage()
-			log.Printf("CPU temperature: %v\n", cpuTemp)
-			log.Printf("GPIO pin state: %v\n", pinState(pin))
+	if err := checkChoice("initial-state", c.initialState, "on", "off", "auto"); err != nil {
+		return err
+	}
+	if err := checkChoice("dump-signal", c.dumpSignal, "usr1", "usr2"); err != nil {
+		return err
+	}
+	if err := checkChoice("quit-action", c.quitAction, "dump-exit", "dump", "exit"); err != nil {
+		return err
+	}
+	if err := checkChoice("out-pull", c.outPull, "up", "down", "off", "none"); err != nil {
+		return err
+	}
+	if err := checkChoice("shutdown-fan", c.shutdownFan, "on", "off", "hold"); err != nil {
+		return err
+	}
+	if err := checkChoice("disabled-state", c.disabledState, "on", "off", "hold"); err != nil {
+		return err
+	}
+	if err := checkChoice("round", c.rounding, "trunc", "round", "ceil"); err != nil {
+		return err
+	}
+	if err := checkChoice("control-source", c.controlSource, "temp", "load"); err != nil {
+		return err
+	}
+	if c.report != "" {
+		if err := checkChoice("report", c.report, "json"); err != nil {
+			return err
 		}
+	}
 
-		/*
-			if cpuTemp <= stop {
-				state := pinState(pin)
-				if state == 1 {
-					fanOff(pin)
-				}
-			} else {
-				fanOn(pin)
-			}
-		*/
-
-		if cpuTemp >= start {
-			fanOn(pin)
-		} else if cpuTemp <= stop {
-			state := pinState(pin)
-			if state == 1 {
-				fanOff(pin)
+	if c.thermalType != "" && (c.thermal || c.hwmon != "") {
+		return fmt.Errorf("'-thermal-type' cannot be combined with '-thermal' or '-hwmon'")
+	}
+	if c.i2cBus >= 0 {
+		if c.thermal || c.hwmon != "" || c.thermalType != "" {
+			return fmt.Errorf("'-i2c-bus' cannot be combined with '-thermal', '-thermal-type' or '-hwmon'")
+		}
+		if _, ok := i2cSensorBits[c.i2cType]; !ok {
+			return fmt.Errorf("invalid i2c-sensor %q (expected 'lm75', 'lm75b' or 'tmp102')", c.i2cType)
+		}
+		if c.i2cAddr < 0x03 || c.i2cAddr > 0x77 {
+			return fmt.Errorf("invalid i2c-addr 0x%02x (expected 0x03..0x77)", c.i2cAddr)
+		}
+	}
+	if c.simulate && c.simCooling <= 0 {
+		return fmt.Errorf("'-sim-cooling' must be positive")
+	}
+	if c.simulate && c.simFanCooling < 0 {
+		return fmt.Errorf("'-sim-fan-cooling' must not be negative")
+	}
+
+	// two speed fans and fan pairs need GPIO and a low speed threshold
+	// between the others
+	if c.gpioHigh >= 0 && c.gpioPair >= 0 {
+		return fmt.Errorf("'-gpio-high' cannot be combined with '-gpio-pair'")
+	}
+	if c.gpioHigh >= 0 || c.gpioPair >= 0 {
+		if c.fanCmd != "" || c.noGPIO || c.simulate {
+			return fmt.Errorf("'-gpio-high' and '-gpio-pair' cannot be combined with '-fan-cmd', '-no-gpio' or '-simulate'")
+		}
+		start, stop := c.thresholds()
+		if c.mid < stop || c.mid > start {
+			return fmt.Errorf("mid threshold (%d) must be between stop (%d) and start (%d)", c.mid, stop, start)
+		}
+	}
+	for _, output := range strings.Split(c.outputs, ",") {
+		switch output {
+		case "gpio":
+		case "cmd":
+			if strings.TrimSpace(c.fanCmd) == "" {
+				return fmt.Errorf("output 'cmd' requires '-fan-cmd'")
 			}
+		default:
+			return fmt.Errorf("invalid output %q (expected 'gpio' or 'cmd')", output)
 		}
+	}
+	if c.enableGPIO >= 0 && (c.simulate || c.noGPIO) {
+		return fmt.Errorf("'-enable-gpio' cannot be combined with '-simulate' or '-no-gpio'")
+	}
+	if c.heatGPIO >= 0 {
+		if c.simulate || c.noGPIO || c.controlSource != "temp" {
+			return fmt.Errorf("'-heat-gpio' requires GPIO and a temperature source")
+		}
+		if c.heatOn >= c.heatOff {
+			return fmt.Errorf("heater on threshold (%d) must be below heater off threshold (%d)", c.heatOn, c.heatOff)
+		}
+	}
+	// alerts compare the control input against a temperature
+	if c.alertTemp > 0 && c.controlSource == "load" {
+		return fmt.Errorf("'-alert-temp' cannot be combined with '-control-source load'")
+	}
+	if c.syslogOnly && c.syslog == "" {
+		return fmt.Errorf("'-syslog-only' requires '-syslog'")
+	}
+	return nil
+}
+
+// thresholdsFromTarget derives the start and stop thresholds from a target
+// temperature and a band centred on it. An odd band puts the extra degree
+// above the target, so the thresholds are always exactly band apart.
+func thresholdsFromTarget(target int, band int) (int, int, error) {
+	if band < 0 {
+		return 0, 0, fmt.Errorf("band (%d) must not be negative", band)
+	}
+	stop := target - band/2
+	return stop + band, stop, nil
+}
 
-		time.Sleep(time.Duration(timeout) * time.Second)
+// checkChoice verifies that a flag value is one of the accepted choices
+func checkChoice(name string, value string, choices ...string) error {
+	for _, c := range choices {
+		if value == c {
+			return nil
+		}
 	}
+	return fmt.Errorf("invalid '-%s' value %q (expected one of: %s)", name, value, strings.Join(choices, ", "))
+}
+
+// usageSections lists the usage() sections in display order
+var usageSections = []string{"Sensing", "Control", "Output", "Alerts", "Metrics", "Lifecycle", "Simulation", "Other"}
+
+// usageGroups maps each flag to its usage() section. Flags missing here are
+// listed under "Other".
+var usageGroups = map[string]string{
+	"thermal":            "Sensing",
+	"thermal-type":       "Sensing",
+	"hwmon":              "Sensing",
+	"i2c-bus":            "Sensing",
+	"i2c-addr":           "Sensing",
+	"i2c-sensor":         "Sensing",
+	"round":              "Sensing",
+	"control-source":     "Sensing",
+	"load-start":         "Control",
+	"load-stop":          "Control",
+	"read-timeout":       "Sensing",
+	"samples-per-poll":   "Sensing",
+	"list-sensors":       "Sensing",
+	"check-config":       "Lifecycle",
+	"temp-min-valid":     "Sensing",
+	"clamp-min":          "Sensing",
+	"clamp-max":          "Sensing",
+	"temp-max-valid":     "Sensing",
+	"start":              "Control",
+	"target":             "Control",
+	"band":               "Control",
+	"stop":               "Control",
+	"mid":                "Control",
+	"gpio-pair":          "Output",
+	"rotate-interval":    "Output",
+	"control-mode":       "Control",
+	"initial-state":      "Control",
+	"min-on-cycles":      "Control",
+	"debounce-count":     "Control",
+	"purge-interval":     "Control",
+	"purge-duration":     "Control",
+	"reassert-interval":  "Output",
+	"shutdown-fan":       "Output",
+	"gpio":               "Output",
+	"gpio-high":          "Output",
+	"out-pull":           "Output",
+	"no-gpio":            "Output",
+	"verify-writes":      "Output",
+	"enable-gpio":        "Control",
+	"disabled-state":     "Control",
+	"enable-debounce-ms": "Control",
+	"heat-gpio":          "Output",
+	"heat-on":            "Output",
+	"heat-off":           "Output",
+	"fan-cmd":            "Output",
+	"outputs":            "Output",
+	"fan-cmd-timeout":    "Output",
+	"alert-temp":         "Alerts",
+	"alert-cooldown":     "Alerts",
+	"smtp-host":          "Alerts",
+	"smtp-port":          "Alerts",
+	"smtp-user":          "Alerts",
+	"smtp-password":      "Alerts",
+	"smtp-from":          "Alerts",
+	"smtp-to":            "Alerts",
+	"timeout":            "Lifecycle",
+	"textfile-dir":       "Metrics",
+	"expvar-addr":        "Metrics",
+	"textfile-interval":  "Metrics",
+	"jitter":             "Lifecycle",
+	"interval-idle":      "Lifecycle",
+	"interval-active":    "Lifecycle",
+	"once":               "Lifecycle",
+	"report":             "Lifecycle",
+	"autotune":           "Lifecycle",
+	"apply":              "Lifecycle",
+	"simulate":           "Simulation",
+	"sim-ambient":        "Simulation",
+	"sim-heat":           "Simulation",
+	"sim-cooling":        "Simulation",
+	"sim-fan-cooling":    "Simulation",
+	"tui":                "Lifecycle",
+	"deadman-timeout":    "Lifecycle",
+	"hold-errors":        "Lifecycle",
+	"failsafe-errors":    "Lifecycle",
+	"log-delta":          "Lifecycle",
+	"quiet-below":        "Lifecycle",
+	"mem-stats-interval": "Lifecycle",
+	"events-file":        "Lifecycle",
+	"syslog":             "Lifecycle",
+	"syslog-only":        "Lifecycle",
+	"nice":               "Lifecycle",
+	"cpu-affinity":       "Lifecycle",
+	"dump-signal":        "Lifecycle",
+	"quit-action":        "Lifecycle",
 }
 
 func usage() {
-	fmt.Print("\n")
-	fmt.Printf("Usage of %s:\n", os.Args[0])
-	fmt.Print("\n")
-	fmt.Print("'-start' Temperature threshold (start)\n")
-	fmt.Print("'-stop'  Temperature threshold (stop)\n")
-	fmt.Print("'-timeout' Timeout in seconds\n")
-	fmt.Print("'-thermal' Thermal information source\n")
-	fmt.Print("'-gpio' GPIO pin\n")
-	fmt.Print("\n")
-	fmt.Print("Example:\n")
-	fmt.Print("\n")
-	fmt.Printf("'%s -start 68 -stop 60 -timeout 5 -thermal /sys/class/thermal/thermal_zone0/temp -gpio 2'", os.Args[0])
-	fmt.Print("\n")
+	sections := make(map[string][]*flag.Flag)
+	flag.VisitAll(func(f *flag.Flag) {
+		section, ok := usageGroups[f.Name]
+		if !ok {
+			section = "Other"
+		}
+		sections[section] = append(sections[section], f)
+	})
+
+	out := flag.CommandLine.Output()
+	fmt.Fprint(out, "\n")
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, section := range usageSections {
+		if len(sections[section]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", section)
+		for _, f := range sections[section] {
+			if f.DefValue == "" {
+				fmt.Fprintf(w, "  -%s\t%s\n", f.Name, f.Usage)
+				continue
+			}
+			fmt.Fprintf(w, "  -%s\t%s (default %q)\n", f.Name, f.Usage, f.DefValue)
+		}
+	}
+	w.Flush()
+	fmt.Fprint(out, "\n")
+	fmt.Fprint(out, "Example:\n")
+	fmt.Fprint(out, "\n")
+	fmt.Fprintf(out, "'%s -start 68 -stop 60 -timeout 5 -thermal /sys/class/thermal/thermal_zone0/temp -gpio 2'", os.Args[0])
+	fmt.Fprint(out, "\n")
 }
 
 func main() {
@@ -119,44 +486,618 @@ func main() {
 	// register command line flags
 	startFan := flag.Int("start", 68, "Temperature threshold (start)")
 	stopFan := flag.Int("stop", 60, "Temperature threshold (stop)")
+	target := flag.Int("target", 0, "Target temperature; derives start/stop from '-band' instead of '-start'/'-stop'")
+	band := flag.Int("band", 6, "Width of the band around '-target'")
 	timeout := flag.Int("timeout", 5, "Timeout in seconds")
+	intervalIdle := flag.Int("interval-idle", 0, "Timeout in seconds while the fan is off and the temperature at or below stop (0: '-timeout')")
+	intervalActive := flag.Int("interval-active", 0, "Timeout in seconds while the fan runs or the temperature is above stop (0: '-timeout')")
+	jitter := flag.Int("jitter", 0, "Randomize the timeout by up to +/- this many seconds")
 	thermalInfo := flag.String("thermal", "/sys/class/thermal/thermal_zone0/temp", "Thermal information source")
+	thermalType := flag.String("thermal-type", "", "Comma separated thermal zone types in order of preference, e.g. 'cpu-thermal,cpu_thermal,soc-thermal'; the first zone found is used instead of '-thermal'")
+	i2cBus := flag.Int("i2c-bus", -1, "Read an I2C temperature sensor on this bus (/dev/i2c-N) instead of '-thermal' (-1: none)")
+	i2cAddr := flag.Int("i2c-addr", 0x48, "Address of the I2C temperature sensor")
+	i2cType := flag.String("i2c-sensor", "lm75", "I2C temperature sensor type: 'lm75', 'lm75b' or 'tmp102'")
+	hwmon := flag.String("hwmon", "", "Read an hwmon sensor given as 'chip:label' instead of '-thermal'")
+	checkConfig := flag.Bool("check-config", false, "Validate the settings, including the temperature source, and exit without touching GPIO (status 0: valid, 1: invalid)")
+	listSensorsOnly := flag.Bool("list-sensors", false, "List the available temperature sources and exit")
+	readTimeout := flag.Int("read-timeout", 10, "Abandon a temperature read after this many seconds (0: wait forever)")
+	controlSource := flag.String("control-source", "temp", "Input driving the fan: 'temp' or 'load' (1 minute load average in percent of CPU capacity)")
+	loadStart := flag.Int("load-start", 80, "Load threshold in percent (start), with '-control-source load'")
+	loadStop := flag.Int("load-stop", 50, "Load threshold in percent (stop), with '-control-source load'")
+	samplesPerPoll := flag.Int("samples-per-poll", 1, "Average this many readings taken in a quick burst on each poll")
+	rounding := flag.String("round", "trunc", "Millidegree rounding: 'trunc', 'round' or 'ceil'")
+	tempMinValid := flag.Int("temp-min-valid", -40, "Reject temperature readings below this value")
+	tempMaxValid := flag.Int("temp-max-valid", 125, "Reject temperature readings above this value")
+	clampMin := flag.Int("clamp-min", 0, "Clamp valid readings below this value up to it (only when set)")
+	clampMax := flag.Int("clamp-max", 0, "Clamp valid readings above this value down to it (only when set)")
 	gpio := flag.Int("gpio", 2, "GPIO pin")
+	gpioHigh := flag.Int("gpio-high", -1, "GPIO pin for the high speed of a two speed fan; '-gpio' then drives the low speed (-1: single speed)")
+	gpioPair := flag.Int("gpio-pair", -1, "GPIO pin of a second fan alternating with '-gpio' at low speed, both run at high speed (-1: single fan)")
+	rotateInterval := flag.Int("rotate-interval", 86400, "Seconds a fan of a '-gpio-pair' runs alone before the other one takes over (0: never)")
+	mid := flag.Int("mid", 0, "Temperature threshold for the low speed of a two speed fan, or for one fan of a '-gpio-pair'")
+	controlMode := flag.String("control-mode", "auto", "Control algorithm: 'hysteresis', 'two-speed' (requires '-gpio-high' or '-gpio-pair', and '-mid') or 'auto' (two-speed for two speed fans)")
+	initialState := flag.String("initial-state", "auto", "Fan state on startup: 'on', 'off' or 'auto'")
+	minOnCycles := flag.Int("min-on-cycles", 0, "Keep the fan on for at least this many iterations once started")
+	debounceCount := flag.Int("debounce-count", 0, "Only change the fan state after this many consecutive readings agree")
+	purgeInterval := flag.Int("purge-interval", 0, "Run the fan at full speed every this many seconds regardless of temperature (0: disabled)")
+	purgeDuration := flag.Int("purge-duration", 30, "Duration in seconds of each air purge")
+	reassertInterval := flag.Int("reassert-interval", 0, "Re-write the fan state every this many seconds even if unchanged (0: only on transitions)")
+	outPull := flag.String("out-pull", "none", "Pull resistor on the GPIO pin: 'up', 'down', 'off' or 'none' (leave as is)")
+	shutdownFan := flag.String("shutdown-fan", "off", "Fan state left on shutdown: 'off', 'on' (keep cooling) or 'hold' (leave as is)")
+	verifyWrites := flag.Bool("verify-writes", false, "Read GPIO outputs back after each write and retry on mismatch")
+	noGPIO := flag.Bool("no-gpio", false, "Keep the fan state in memory instead of driving GPIO (for testing without a Pi)")
+	outputs := flag.String("outputs", "", "Comma separated fan outputs: 'gpio', 'cmd' or both (default: 'cmd' with '-fan-cmd', 'gpio' otherwise)")
+	enableGPIO := flag.Int("enable-gpio", -1, "GPIO input enabling automatic control while high (pulled up; a switch to ground disables) (-1: none)")
+	enableDebounce := flag.Int("enable-debounce-ms", 50, "Milliseconds the enable input must settle after an edge before it is honoured")
+	disabledState := flag.String("disabled-state", "off", "Fan state held while the enable input is low: 'off', 'on' or 'hold'")
+	heatGPIO := flag.Int("heat-gpio", -1, "GPIO output driving a heater, independently of the fan (-1: none)")
+	heatOn := flag.Int("heat-on", 0, "Turn the heater on at or below this temperature")
+	heatOff := flag.Int("heat-off", 5, "Turn the heater off at or above this temperature")
+	fanCmd := flag.String("fan-cmd", "", "Drive the fan with this command instead of GPIO, split on spaces and called with 'on' or 'off' appended")
+	fanCmdTimeout := flag.Int("fan-cmd-timeout", 10, "Timeout in seconds for the fan command")
+	once := flag.Bool("once", false, "Run a single iteration and exit (status 0: fan off, 2: fan on)")
+	nice := flag.Int("nice", 0, "Niceness applied at startup, e.g. -10 to keep the control loop responsive under load (0: unchanged)")
+	cpuAffinity := flag.Int("cpu-affinity", -1, "Pin the process to this CPU (-1: any)")
+	syslogServer := flag.String("syslog", "", "Also send the log to this syslog server: 'udp://host:port' or 'tcp://host:port'")
+	syslogOnly := flag.Bool("syslog-only", false, "Send the log only to the '-syslog' server, not to stderr")
+	eventsFile := flag.String("events-file", "", "Append every fan transition to this file as a JSON line")
+	memStatsInterval := flag.Int("mem-stats-interval", 0, "Log the memory usage every this many seconds (0: disabled)")
+	quietBelow := flag.Int("quiet-below", 0, "Suppress routine per-poll logging while the value is below this; transitions are still logged (only when set)")
+	logDelta := flag.Int("log-delta", 0, "Log the temperature when it changes by more than this since the last logged value (0: disabled)")
+	dumpSignal := flag.String("dump-signal", "usr1", "Signal that logs a state snapshot: 'usr1' or 'usr2'; the other one pauses/resumes control")
+	quitAction := flag.String("quit-action", "exit", "Action on SIGQUIT: 'exit' stops as on SIGTERM, 'dump-exit' logs all goroutine stacks and stops, 'dump' logs them and keeps running")
+	simulate := flag.Bool("simulate", false, "Use a simulated temperature and fan instead of the thermal source and GPIO")
+	simAmbient := flag.Float64("sim-ambient", 35, "Simulated ambient temperature")
+	simHeat := flag.Float64("sim-heat", 0.5, "Simulated heating by the load, in degrees per second")
+	simCooling := flag.Float64("sim-cooling", 0.01, "Simulated passive cooling coefficient per second")
+	simFanCooling := flag.Float64("sim-fan-cooling", 0.05, "Simulated additional cooling coefficient per second while the fan runs")
+	holdErrors := flag.Int("hold-errors", 0, "Keep running and hold the fan state after this many consecutive read failures (0: exit on the first failure unless '-failsafe-errors' is set)")
+	failsafeErrors := flag.Int("failsafe-errors", 0, "Force the fan on after this many consecutive read failures, holding its state from the first one unless '-hold-errors' is set (0: never)")
+	deadmanTimeout := flag.Int("deadman-timeout", 0, "Force the fan on if the control loop stalls for this many seconds (0: disabled)")
+	report := flag.String("report", "", "Like '-once', printing the result as 'json' (status 0: fan off, 2: fan on)")
+	apply := flag.Bool("apply", false, "Apply the fan state with '-report' (default: leave the fan alone)")
+	autotune := flag.Int("autotune", 0, "Observe the temperature for this many seconds, cycling the fan, then print suggested thresholds and exit")
+	textfileDir := flag.String("textfile-dir", "", "Write metrics to pifan.prom in this node_exporter textfile directory")
+	textfileInterval := flag.Int("textfile-interval", 0, "Minimum seconds between textfile writes (0: every poll)")
+	expvarAddr := flag.String("expvar-addr", "", "Serve the current state as expvar on this address under /debug/vars, e.g. 'localhost:9181'")
+	tuiMode := flag.Bool("tui", false, "Show a live terminal dashboard")
+	alertTemp := flag.Int("alert-temp", 0, "Send an alert email at or above this temperature (0: disabled)")
+	alertCooldown := flag.Int("alert-cooldown", 900, "Minimum seconds between alert emails")
+	smtpHost := flag.String("smtp-host", "", "SMTP server host")
+	smtpPort := flag.Int("smtp-port", 25, "SMTP server port")
+	smtpUser := flag.String("smtp-user", "", "SMTP username (enables authentication)")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password")
+	smtpFrom := flag.String("smtp-from", "", "Alert email sender")
+	smtpTo := flag.String("smtp-to", "", "Alert email recipients (comma separated)")
 	// replace default usage message
 	flag.Usage = usage
 	// parse command line flags
 	flag.Parse()
 
-	// open GPIO mem
-	if err := rpio.Open(); err != nil {
+	if *listSensorsOnly {
+		listSensors(os.Stdout)
+		return
+	}
+
+	// remote syslog
+	var syslogOut *syslogWriter
+	if *syslogServer != "" {
+		var err error
+		syslogOut, err = newSyslogWriter(*syslogServer)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if *syslogOnly {
+			log.SetOutput(syslogOut)
+		} else {
+			log.SetOutput(io.MultiWriter(os.Stderr, syslogOut))
+		}
+	}
+
+	// scheduling priority and CPU affinity, only a warning when unavailable
+	if *nice != 0 {
+		if err := setNice(*nice); err != nil {
+			log.Printf("Could not set niceness %d: %v\n", *nice, err)
+		} else {
+			log.Printf("Niceness set to %d\n", *nice)
+		}
+	}
+	if *cpuAffinity >= 0 {
+		if err := setAffinity(*cpuAffinity); err != nil {
+			log.Printf("Could not pin to CPU %d: %v\n", *cpuAffinity, err)
+		} else {
+			log.Printf("Pinned to CPU %d\n", *cpuAffinity)
+		}
+	}
+
+	// derive thresholds from the target temperature
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if setFlags["band"] && !setFlags["target"] {
+		log.Println("'-band' requires '-target'")
+		os.Exit(1)
+	}
+	if setFlags["target"] {
+		if setFlags["start"] || setFlags["stop"] {
+			log.Println("'-target' cannot be combined with '-start' or '-stop'")
+			os.Exit(1)
+		}
+		var err error
+		*startFan, *stopFan, err = thresholdsFromTarget(*target, *band)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		log.Printf("Target %v, band %v: start %v, stop %v\n", *target, *band, *startFan, *stopFan)
+	}
+
+	if *outputs == "" {
+		*outputs = "gpio"
+		if *fanCmd != "" {
+			*outputs = "cmd"
+		}
+	}
+	cfg := config{
+		start: *startFan, stop: *stopFan, mid: *mid,
+		loadStart: *loadStart, loadStop: *loadStop,
+		minValid: *tempMinValid, maxValid: *tempMaxValid,
+		timeout: *timeout, intervalIdle: *intervalIdle, intervalActive: *intervalActive, jitter: *jitter,
+		readTimeout: *readTimeout, fanCmdTimeout: *fanCmdTimeout, deadmanTimeout: *deadmanTimeout,
+		holdErrors: *holdErrors, failsafeErrors: *failsafeErrors,
+		initialState: *initialState, outPull: *outPull, dumpSignal: *dumpSignal, quitAction: *quitAction,
+		shutdownFan: *shutdownFan, disabledState: *disabledState, rounding: *rounding,
+		controlSource: *controlSource, report: *report,
+		thermal: setFlags["thermal"], thermalType: *thermalType, hwmon: *hwmon,
+		i2cBus: *i2cBus, i2cAddr: *i2cAddr, i2cType: *i2cType,
+		gpioHigh: *gpioHigh, gpioPair: *gpioPair, enableGPIO: *enableGPIO, heatGPIO: *heatGPIO,
+		heatOn: *heatOn, heatOff: *heatOff,
+		outputs: *outputs, fanCmd: *fanCmd, noGPIO: *noGPIO, simulate: *simulate,
+		simCooling: *simCooling, simFanCooling: *simFanCooling,
+		alertTemp: *alertTemp, syslog: *syslogServer, syslogOnly: *syslogOnly,
+	}
+	if setFlags["clamp-min"] {
+		cfg.clampMin = clampMin
+	}
+	if setFlags["clamp-max"] {
+		cfg.clampMax = clampMax
+	}
+	if err := validateConfig(cfg); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	// pick the thermal zone by type
+	if *thermalType != "" {
+		path, err := detectThermalZone(strings.Split(*thermalType, ","))
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		log.Printf("Using thermal zone %s\n", path)
+		*thermalInfo = path
+	}
+
+	// resolve the hwmon sensor to its input file
+	if *hwmon != "" {
+		path, err := resolveHwmon(*hwmon)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		log.Printf("Using hwmon sensor %s: %s\n", *hwmon, path)
+		*thermalInfo = path
+	}
+
+	// I2C sensor; its bus device is validated like a thermal path
+	var i2c *i2cSensor
+	if *i2cBus >= 0 {
+		i2c = &i2cSensor{bus: *i2cBus, addr: *i2cAddr, kind: *i2cType, rounding: *rounding}
+		log.Printf("Using %s sensor %s\n", *i2cType, i2c)
+		*thermalInfo = i2c.path()
+	}
+
+	// catch a thermal path that is a directory or unreadable before the
+	// first read
+	if *controlSource == "temp" && !*simulate {
+		if err := validateSource(*thermalInfo); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// control algorithm, on the load thresholds when controlling on load
+	algStart, algStop := cfg.thresholds()
+	algorithm, err := newAlgorithm(*controlMode, *gpioHigh >= 0 || *gpioPair >= 0, algStart, *mid, algStop)
+	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 
-	// keep GPIO mem open until program end
-	defer rpio.Close()
+	// set up alert emails
+	var alert *alerter
+	if *alertTemp > 0 {
+		var err error
+		alert, err = newAlerter(*smtpHost, *smtpPort, *smtpUser, *smtpPassword, *smtpFrom, *smtpTo, *alertTemp, *alertCooldown)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// all settings validated, stop before touching any hardware
+	if *checkConfig {
+		fmt.Println("Configuration OK")
+		return
+	}
+
+	// '-report' without '-apply' only reads, it must not touch GPIO
+	dryRun := *report != "" && !*apply
 
-	// set GPIO pin
-	pin := rpio.Pin(*gpio)
-	pin.Output()
+	// set up the fan output
+	var fan Fan
+	var speed speedFan
+	var pair *fanPair
+	gpioOpen := false
+	if *simulate || *noGPIO || dryRun {
+		// memory backed fan, GPIO is never touched
+		fan = &memFan{}
+	} else {
+		var fans multiFan
+		for _, output := range strings.Split(*outputs, ",") {
+			switch output {
+			case "cmd":
+				fans = append(fans, &cmdFan{command: *fanCmd, timeout: time.Duration(*fanCmdTimeout) * time.Second})
+			case "gpio":
+				// open GPIO mem
+				if err := rpio.Open(); err != nil {
+					log.Println(err)
+					os.Exit(1)
+				}
+				gpioOpen = true
+
+				// set GPIO pins
+				if *gpioHigh >= 0 {
+					speed = &twoSpeedFan{
+						low:    setupPin(*gpio, *outPull, false),
+						high:   setupPin(*gpioHigh, *outPull, false),
+						verify: *verifyWrites,
+					}
+					fans = append(fans, speed)
+				} else if *gpioPair >= 0 {
+					pair = &fanPair{
+						pins:   [2]rpio.Pin{setupPin(*gpio, *outPull, false), setupPin(*gpioPair, *outPull, false)},
+						rotate: time.Duration(*rotateInterval) * time.Second,
+						verify: *verifyWrites,
+					}
+					speed = pair
+					fans = append(fans, speed)
+				} else {
+					fans = append(fans, &gpioFan{pin: setupPin(*gpio, *outPull, *initialState == "on"), verify: *verifyWrites})
+				}
+			}
+		}
+		fan = fans
+		if len(fans) == 1 {
+			fan = fans[0]
+		}
+	}
+
+	// external enable input, followed by edge detection
+	wake := make(chan struct{}, 1)
+	var enable *enableInput
+	if *enableGPIO >= 0 && !dryRun {
+		if !gpioOpen {
+			if err := rpio.Open(); err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			gpioOpen = true
+		}
+		enable = watchEnable(rpio.Pin(*enableGPIO), time.Duration(*enableDebounce)*time.Millisecond, wake)
+	}
+
+	// antifreeze heater output
+	var heat *heater
+	if *heatGPIO >= 0 && !dryRun {
+		if !gpioOpen {
+			if err := rpio.Open(); err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			gpioOpen = true
+		}
+		heat = &heater{pin: setupPin(*heatGPIO, "none", false), on: *heatOn, off: *heatOff}
+	}
+
+	// release GPIO mem, if it was opened
+	closeGPIO := func() {
+		if enable != nil {
+			enable.stop()
+			enable = nil
+		}
+		if gpioOpen {
+			rpio.Close()
+			gpioOpen = false
+		}
+	}
+
+	ctl := &controller{
+		start:          *startFan,
+		stop:           *stopFan,
+		timeout:        *timeout,
+		intervalIdle:   *intervalIdle,
+		intervalActive: *intervalActive,
+		jitter:         *jitter,
+		input:          "CPU temperature",
+		thermal:        *thermalInfo,
+		readTimeout:    time.Duration(*readTimeout) * time.Second,
+		source: func() (int, error) {
+			return currentTemp(*thermalInfo, *rounding)
+		},
+		minValid:       *tempMinValid,
+		maxValid:       *tempMaxValid,
+		reassert:       time.Duration(*reassertInterval) * time.Second,
+		logDelta:       *logDelta,
+		minOnCycles:    *minOnCycles,
+		debounceCount:  *debounceCount,
+		purgeInterval:  time.Duration(*purgeInterval) * time.Second,
+		purgeDuration:  time.Duration(*purgeDuration) * time.Second,
+		fan:            fan,
+		speed:          speed,
+		pair:           pair,
+		wake:           wake,
+		quit:           make(chan struct{}),
+		holdErrors:     *holdErrors,
+		failsafeErrors: *failsafeErrors,
+		heater:         heat,
+		disabledState:  *disabledState,
+		alert:          alert,
+		algorithm:      algorithm,
+	}
+
+	if *hwmon != "" {
+		ctl.source = (&hwmonSource{spec: *hwmon, path: *thermalInfo, rounding: *rounding}).read
+	}
+	if i2c != nil {
+		ctl.source = i2c.read
+		ctl.thermal = i2c.String()
+	}
+	if *controlSource == "load" {
+		ctl.source = readLoad
+		ctl.input = "Load"
+		ctl.thermal = loadavgPath
+		ctl.start, ctl.stop = *loadStart, *loadStop
+		// load percentages are not temperatures
+		ctl.minValid, ctl.maxValid = 0, math.MaxInt32
+		log.Printf("Controlling on load: start %v%%, stop %v%%\n", ctl.start, ctl.stop)
+	}
+	if *simulate {
+		sim := newSimulator(fan, *simAmbient, *simHeat, *simCooling, *simFanCooling)
+		ctl.source = sim.read
+		ctl.thermal = "simulation"
+		log.Print("Simulating temperature and fan\n")
+	}
+
+	if setFlags["quiet-below"] {
+		ctl.quietBelow = quietBelow
+	}
+
+	if setFlags["clamp-min"] {
+		ctl.clampMin = clampMin
+	}
+	if setFlags["clamp-max"] {
+		ctl.clampMax = clampMax
+	}
+
+	if *samplesPerPoll > 1 {
+		ctl.source = averagedSource(ctl.source, *samplesPerPoll)
+	}
+
+	if enable != nil {
+		ctl.enabled = enable.enabled.Load
+	}
+
+	// stop the fan and exit, only once even if several signals or a fatal
+	// error arrive. The order matters: the expvar server is stopped first,
+	// then the control loop so that nothing drives the outputs behind our
+	// back, the outputs are put in their shutdown state, and GPIO memory is
+	// only released once nothing uses it. Files are closed and the syslog
+	// queue flushed last.
+	var shutdownOnce sync.Once
+	// closed when the control loop returns, nil until it is started
+	var loopDone chan struct{}
+	// nil unless '-expvar-addr' is set
+	var expvarServer *http.Server
+	shutdown := func(code int) {
+		shutdownOnce.Do(func() {
+			log.Print("Stopping PiFan fan monitor...\n")
+
+			var steps []shutdownStep
+			if expvarServer != nil {
+				steps = append(steps, shutdownStep{"stopping the expvar server", expvarServer})
+			}
+			steps = append(steps, shutdownStep{"stopping the control loop", closerFunc(func(ctx context.Context) error {
+				close(ctl.quit)
+				if loopDone == nil {
+					return nil
+				}
+				select {
+				case <-loopDone:
+					return nil
+				case <-ctx.Done():
+					return fmt.Errorf("still busy after %v, continuing", shutdownTimeout)
+				}
+			})})
+			if ctl.ui != nil {
+				steps = append(steps, shutdownStep{"closing the dashboard", closerFunc(func(ctx context.Context) error {
+					ctl.ui.close()
+					return nil
+				})})
+			}
+			steps = append(steps, shutdownStep{"fan to its shutdown state", closerFunc(func(ctx context.Context) error {
+				ctl.fanMu.Lock()
+				defer ctl.fanMu.Unlock()
+				switch *shutdownFan {
+				case "on":
+					fan.On()
+				case "off":
+					fan.Off()
+				}
+				log.Printf("Fan left %s\n", stateName(fan.State() == 1))
+				return nil
+			})})
+			if heat != nil {
+				steps = append(steps, shutdownStep{"heater off", closerFunc(func(ctx context.Context) error {
+					heat.stop()
+					return nil
+				})})
+			}
+			steps = append(steps, shutdownStep{"releasing GPIO", closerFunc(func(ctx context.Context) error {
+				closeGPIO()
+				return nil
+			})})
+			if ctl.events != nil {
+				steps = append(steps, shutdownStep{"closing the events file", closerFunc(func(ctx context.Context) error {
+					return ctl.events.close()
+				})})
+			}
+			runShutdown(steps, shutdownTimeout)
+
+			log.Print("PiFan fan monitor: stopped.\n")
+			if syslogOut != nil {
+				syslogOut.close(shutdownTimeout)
+			}
+			os.Exit(code)
+		})
+	}
+
+	// the one-shot modes leave the fan as it is, but not the heater
+	finish := func(code int) {
+		if heat != nil {
+			heat.stop()
+		}
+		closeGPIO()
+		if syslogOut != nil {
+			syslogOut.close(shutdownTimeout)
+		}
+		os.Exit(code)
+	}
+
+	// explicit starting state
+	if err := ctl.setInitialState(*initialState); err != nil {
+		log.Println(err)
+		shutdown(1)
+	}
+	ctl.stats = newStats(ctl.running)
+
+	// threshold suggestion mode
+	if *autotune > 0 {
+		if err := ctl.autotune(time.Duration(*autotune)*time.Second, os.Stdout); err != nil {
+			log.Println(err)
+			shutdown(1)
+		}
+		fan.Off()
+		finish(0)
+	}
+
+	// single iteration mode
+	if *once || *report != "" {
+		cpuTemp, err := ctl.step()
+		if err != nil {
+			log.Println(err)
+			shutdown(1)
+		}
+		code := 0
+		if ctl.running {
+			code = 2
+		}
+		if *report == "json" {
+			out, err := json.Marshal(ctl.stats.report(ctl.input, ctl.start, ctl.stop))
+			if err != nil {
+				log.Println(err)
+				shutdown(1)
+			}
+			fmt.Println(string(out))
+		} else {
+			fmt.Printf("%s: %v, fan: %s\n", ctl.input, cpuTemp, stateName(ctl.running))
+		}
+		finish(code)
+	}
+
+	// node_exporter textfile
+	if *textfileDir != "" {
+		ctl.textfile = &textfile{dir: *textfileDir, interval: time.Duration(*textfileInterval) * time.Second}
+	}
+
+	// memory usage, on its own logger so it can be told apart from the
+	// debug log
+	if *memStatsInterval > 0 {
+		ctl.memStatsInterval = time.Duration(*memStatsInterval) * time.Second
+		ctl.memLog = log.New(log.Writer(), "memstats: ", log.Flags()|log.Lmsgprefix)
+	}
+
+	// fan transition events
+	if *eventsFile != "" {
+		events, err := newEventLog(*eventsFile)
+		if err != nil {
+			log.Println(err)
+			shutdown(1)
+		}
+		ctl.events = events
+	}
+
+	// expvar on /debug/vars
+	if *expvarAddr != "" {
+		expvarServer = publishExpvar(*expvarAddr, ctl.stats, ctl.input)
+	}
+
+	// live terminal dashboard
+	if *tuiMode {
+		ctl.ui = newTUI()
+	}
 
 	// prepare channels, waitgroups and OS signal catches
+	dumpSig, pauseSig := syscall.SIGUSR1, syscall.SIGUSR2
+	if *dumpSignal == "usr2" {
+		dumpSig, pauseSig = syscall.SIGUSR2, syscall.SIGUSR1
+	}
 	var sigCh = make(chan os.Signal, 1)
 	signal.Notify(sigCh,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
-		syscall.SIGQUIT)
+		syscall.SIGQUIT,
+		dumpSig,
+		pauseSig)
 
-	// pre-exit goroutine
+	loopDone = make(chan struct{})
+
+	// signal dispatch goroutine
 	go func() {
-		sig := <-sigCh
-		log.Printf("Caught signal: %+v\n", sig)
-		log.Print("Stopping PiFan fan monitor...\n")
-		fanOff(pin)
-		rpio.Close()
-		log.Print("PiFan fan monitor: stopped.\n")
-		os.Exit(0)
+		for sig := range sigCh {
+			log.Printf("Caught signal: %+v\n", sig)
+			switch sig {
+			case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM:
+				shutdown(0)
+			case syscall.SIGQUIT:
+				if *quitAction != "exit" {
+					log.Printf("Goroutine stacks:\n%s", goroutineStacks())
+				}
+				if *quitAction != "dump" {
+					shutdown(0)
+				}
+			case dumpSig:
+				log.Printf("State: %s\n", ctl.stats.snapshot(ctl.start, ctl.stop))
+				if pair != nil {
+					log.Printf("Fan pair running: %s\n", pair.activePins())
+				}
+			case pauseSig:
+				ctl.togglePause()
+			}
+		}
 	}()
 
 	// prepare waitgroup
@@ -165,12 +1106,25 @@ func main() {
 	// add group
 	wg.Add(1)
 
-	// main goroutine
+	// deadman watchdog goroutine
+	if *deadmanTimeout > 0 {
+		go ctl.deadman(time.Duration(*deadmanTimeout) * time.Second)
+	}
+
+	// main goroutine; a fatal error stops the program like a signal
 	go func() {
-		fanControl(*startFan, *stopFan, *timeout, *thermalInfo, pin)
+		err := ctl.run()
+		close(loopDone)
+		if err != nil {
+			log.Println(err)
+			shutdown(1)
+		}
 		wg.Done()
 	}()
 
 	log.Print("PiFan fan monitor: running.")
 	wg.Wait()
+
+	// the loop only returns on shutdown, which exits the process
+	select {}
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCurrentTemp(t *testing.T) {
+	tests := []struct {
+		content string
+		temp    int
+	}{
+		{"45000\n", 45},
+		{"  45000 \n", 45},
+		{"\t51999\r\n", 51},
+		{"45000 mC\n", 45},
+		{"45000mC", 45},
+	}
+	path := filepath.Join(t.TempDir(), "temp")
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		temp, err := currentTemp(path, "trunc")
+		if err != nil || temp != tt.temp {
+			t.Errorf("%q: got %v (%v), want %v", tt.content, temp, err, tt.temp)
+		}
+	}
+}
+
+func TestCurrentTempInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "temp")
+	for _, content := range []string{"", "\n", "hot\n", "45x000\n", "mC 45"} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := currentTemp(path, "trunc")
+		serr, ok := err.(*SensorError)
+		if !ok || serr.Category != sensorParseError {
+			t.Errorf("%q: got %v, want a parse error", content, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), strings.TrimSpace(content)) {
+			t.Errorf("%q: error %q does not quote the content", content, err)
+		}
+	}
+
+	_, err := currentTemp(filepath.Join(t.TempDir(), "missing"), "trunc")
+	if serr, ok := err.(*SensorError); !ok || serr.Category != sensorNotFound {
+		t.Errorf("missing file: got %v, want not found", err)
+	}
+}
+
+func TestScaleTemp(t *testing.T) {
+	tests := []struct {
+		milli                int64
+		trunc, rounded, ceil int
+	}{
+		{45000, 45, 45, 45},
+		{45001, 45, 45, 46},
+		{45499, 45, 45, 46},
+		{45500, 45, 46, 46},
+		{45999, 45, 46, 46},
+		{-1500, -1, -2, -1},
+	}
+	for _, tt := range tests {
+		for mode, want := range map[string]int{"trunc": tt.trunc, "round": tt.rounded, "ceil": tt.ceil} {
+			if got := scaleTemp(tt.milli, mode); got != want {
+				t.Errorf("%d %s: got %d, want %d", tt.milli, mode, got, want)
+			}
+		}
+	}
+}
+
+// testConfig returns the default settings, which validateConfig accepts
+func testConfig() config {
+	return config{
+		start: 68, stop: 60,
+		loadStart: 80, loadStop: 50,
+		minValid: -40, maxValid: 125,
+		timeout: 5, readTimeout: 10, fanCmdTimeout: 10,
+		initialState: "auto", outPull: "none", dumpSignal: "usr1", quitAction: "exit",
+		shutdownFan: "off", disabledState: "off", rounding: "trunc", controlSource: "temp",
+		i2cBus: -1, i2cAddr: 0x48, i2cType: "lm75",
+		gpioHigh: -1, gpioPair: -1, enableGPIO: -1, heatGPIO: -1,
+		heatOn: 0, heatOff: 5,
+		outputs: "gpio", simCooling: 0.01,
+	}
+}
+
+func TestValidateConfigDefaults(t *testing.T) {
+	if err := validateConfig(testConfig()); err != nil {
+		t.Fatalf("default settings rejected: %v", err)
+	}
+}
+
+func TestValidateConfigTimeout(t *testing.T) {
+	for _, timeout := range []int{0, -1} {
+		c := testConfig()
+		c.timeout = timeout
+		if err := validateConfig(c); err == nil {
+			t.Errorf("timeout %d accepted", timeout)
+		}
+	}
+}
+
+func TestValidateConfigJitter(t *testing.T) {
+	tests := []struct {
+		timeout, idle, active, jitter int
+		ok                            bool
+	}{
+		{5, 0, 0, 4, true},
+		{5, 0, 0, 5, false},
+		{5, 0, 0, 6, false},
+		{5, 0, 0, -1, false},
+		{5, 30, 0, 5, false},
+		{5, 30, 2, 2, false},
+		{5, 30, 2, 1, true},
+	}
+	for _, tt := range tests {
+		c := testConfig()
+		c.timeout, c.intervalIdle, c.intervalActive, c.jitter = tt.timeout, tt.idle, tt.active, tt.jitter
+		if err := validateConfig(c); (err == nil) != tt.ok {
+			t.Errorf("timeout %d, intervals %d/%d, jitter %d: got %v, want ok %v", tt.timeout, tt.idle, tt.active, tt.jitter, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateConfigSettings(t *testing.T) {
+	five := 5
+	tests := map[string]func(*config){
+		"stop above start":    func(c *config) { c.stop = 70 },
+		"clamp min over max":  func(c *config) { c.clampMin, c.clampMax = &five, new(int) },
+		"pair and high":       func(c *config) { c.gpioHigh, c.gpioPair = 3, 4 },
+		"mid outside":         func(c *config) { c.gpioHigh, c.mid = 3, 70 },
+		"negative errors":     func(c *config) { c.failsafeErrors = -1 },
+		"hold after failsafe": func(c *config) { c.holdErrors, c.failsafeErrors = 5, 3 },
+		"cmd output":          func(c *config) { c.outputs = "cmd" },
+		"sim fan cooling":     func(c *config) { c.simulate, c.simFanCooling = true, -0.1 },
+		"enable simulate":     func(c *config) { c.enableGPIO, c.simulate = 5, true },
+		"heater load":         func(c *config) { c.heatGPIO, c.controlSource = 5, "load" },
+		"i2c and thermal":     func(c *config) { c.i2cBus, c.thermal = 1, true },
+		"i2c address":         func(c *config) { c.i2cBus, c.i2cAddr = 1, 0x80 },
+		"syslog only":         func(c *config) { c.syslogOnly = true },
+		"quit action":         func(c *config) { c.quitAction = "bogus" },
+	}
+	for name, change := range tests {
+		c := testConfig()
+		change(&c)
+		if err := validateConfig(c); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestValidateConfigMidLoad(t *testing.T) {
+	c := testConfig()
+	c.gpioHigh, c.controlSource = 3, "load"
+	// between the load thresholds, outside the temperature ones
+	c.mid = 70
+	if err := validateConfig(c); err != nil {
+		t.Fatalf("mid between the load thresholds rejected: %v", err)
+	}
+	c.mid = 90
+	if err := validateConfig(c); err == nil {
+		t.Error("mid above the load start accepted")
+	}
+}
+
+func TestValidateConfigAlertLoad(t *testing.T) {
+	c := testConfig()
+	c.alertTemp = 80
+	if err := validateConfig(c); err != nil {
+		t.Fatalf("alert on temperature rejected: %v", err)
+	}
+	c.controlSource = "load"
+	if err := validateConfig(c); err == nil {
+		t.Error("alert with the load source accepted")
+	}
+}
+
+func TestThresholdsFromTarget(t *testing.T) {
+	tests := []struct {
+		target, band, start, stop int
+	}{
+		{64, 0, 64, 64},
+		{64, 6, 67, 61},
+		{64, 5, 67, 62},
+		{64, 1, 65, 64},
+	}
+	for _, tt := range tests {
+		start, stop, err := thresholdsFromTarget(tt.target, tt.band)
+		if err != nil || start != tt.start || stop != tt.stop {
+			t.Errorf("target %d, band %d: got %d/%d (%v), want %d/%d", tt.target, tt.band, start, stop, err, tt.start, tt.stop)
+		}
+	}
+	if _, _, err := thresholdsFromTarget(64, -1); err == nil {
+		t.Error("negative band accepted")
+	}
+}
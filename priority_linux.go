@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+// Scheduling priority and CPU affinity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// threadIDs lists the threads of the process. Linux applies niceness and
+// affinity per thread, and threads started later inherit them from the
+// thread that creates them.
+func threadIDs() ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	tids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// setNice sets the niceness of all threads of the process
+func setNice(nice int) error {
+	tids, err := threadIDs()
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("setpriority: %w", err)
+		}
+	}
+	return nil
+}
+
+// setAffinity pins all threads of the process to the given CPU
+func setAffinity(cpu int) error {
+	var mask [16]uint64
+	if cpu < 0 || cpu >= len(mask)*64 {
+		return fmt.Errorf("invalid CPU %d", cpu)
+	}
+	mask[cpu/64] = 1 << (uint(cpu) % 64)
+	tids, err := threadIDs()
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+		if errno != 0 {
+			return fmt.Errorf("sched_setaffinity: %w", errno)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+// Scheduling priority and CPU affinity, unsupported outside Linux
+
+import (
+	"errors"
+)
+
+var errPriorityUnsupported = errors.New("not supported on this platform")
+
+func setNice(nice int) error {
+	return errPriorityUnsupported
+}
+
+func setAffinity(cpu int) error {
+	return errPriorityUnsupported
+}
@@ -0,0 +1,170 @@
+package main
+
+// Sensor errors and discovery
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const thermalRoot = "/sys/class/thermal"
+
+// sensor error categories
+const (
+	sensorNotFound   = "not-found"
+	sensorReadError  = "read-error"
+	sensorParseError = "parse-error"
+	sensorOutOfRange = "out-of-range"
+	sensorTimeout    = "timeout"
+)
+
+// SensorError is a failed temperature read, classified by category so
+// that a missing source can be told apart from a glitch in its content
+type SensorError struct {
+	Category string
+	Source   string
+	Err      error
+}
+
+func (e *SensorError) Error() string {
+	return fmt.Sprintf("sensor %s (%s): %v", e.Source, e.Category, e.Err)
+}
+
+func (e *SensorError) Unwrap() error {
+	return e.Err
+}
+
+// validateSource checks that path, after following symlinks, is a readable
+// regular file or character device. The real target of a symlinked path is
+// logged.
+func validateSource(path string) error {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return &SensorError{Category: sensorNotFound, Source: path, Err: err}
+	}
+	if real != path {
+		log.Printf("Sensor %s resolves to %s\n", path, real)
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return &SensorError{Category: sensorNotFound, Source: path, Err: err}
+	}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		return &SensorError{Category: sensorNotFound, Source: path, Err: fmt.Errorf("is a directory, expected a file such as %s", filepath.Join(path, "temp"))}
+	case !mode.IsRegular() && mode&os.ModeCharDevice == 0:
+		return &SensorError{Category: sensorNotFound, Source: path, Err: fmt.Errorf("not a regular file or character device (%v)", mode.Type())}
+	}
+	f, err := os.Open(real)
+	if err != nil {
+		return &SensorError{Category: sensorReadError, Source: path, Err: err}
+	}
+	return f.Close()
+}
+
+// detectThermalZone returns the input file of the first thermal zone whose
+// type matches one of types, in order of preference. All zones found are
+// logged.
+func detectThermalZone(types []string) (string, error) {
+	zones, err := filepath.Glob(filepath.Join(thermalRoot, "thermal_zone*"))
+	if err != nil {
+		return "", err
+	}
+	found := make(map[string]string)
+	for _, zone := range zones {
+		zoneType := readTrimmed(filepath.Join(zone, "type"))
+		log.Printf("Thermal zone %s: %s\n", filepath.Base(zone), zoneType)
+		if _, ok := found[zoneType]; !ok {
+			found[zoneType] = filepath.Join(zone, "temp")
+		}
+	}
+	for i, t := range types {
+		types[i] = strings.TrimSpace(t)
+		if input, ok := found[types[i]]; ok {
+			return input, nil
+		}
+	}
+	return "", fmt.Errorf("no thermal zone of type %s under %s", strings.Join(types, ", "), thermalRoot)
+}
+
+// listSensors prints the temperature sources found on this board, with
+// the flag that selects each one and its current reading
+func listSensors(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "TYPE\tLABEL\tREADING\tFLAG\n")
+
+	zones, _ := filepath.Glob(filepath.Join(thermalRoot, "thermal_zone*"))
+	for _, zone := range zones {
+		input := filepath.Join(zone, "temp")
+		fmt.Fprintf(w, "thermal\t%s\t%s\t-thermal %s\n", readTrimmed(filepath.Join(zone, "type")), sensorReading(input), input)
+	}
+
+	devices, _ := filepath.Glob(filepath.Join(hwmonRoot, "hwmon*"))
+	for _, dev := range devices {
+		chip := readTrimmed(filepath.Join(dev, "name"))
+		inputs, _ := filepath.Glob(filepath.Join(dev, "temp*_input"))
+		for _, input := range inputs {
+			channel := strings.TrimSuffix(filepath.Base(input), "_input")
+			label := readTrimmed(filepath.Join(dev, channel+"_label"))
+			if label == "" {
+				label = channel
+			}
+			fmt.Fprintf(w, "hwmon\t%s:%s\t%s\t-hwmon %s:%s\n", chip, label, sensorReading(input), chip, label)
+		}
+	}
+
+	probes, _ := filepath.Glob("/sys/bus/w1/devices/28-*")
+	for _, probe := range probes {
+		input := filepath.Join(probe, "temperature")
+		fmt.Fprintf(w, "w1\t%s\t%s\t-thermal %s\n", filepath.Base(probe), sensorReading(input), input)
+	}
+	w.Flush()
+}
+
+func sensorReading(input string) string {
+	temp, err := currentTemp(input, "trunc")
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(temp)
+}
+
+// delay between the samples of a burst
+const sampleGap = 100 * time.Millisecond
+
+// averagedSource reads source samples times in a quick burst and returns
+// the average, so that a longer poll interval still gets a fresh value
+func averagedSource(source func() (int, error), samples int) func() (int, error) {
+	return func() (int, error) {
+		sum, min, max := 0, 0, 0
+		for i := 0; i < samples; i++ {
+			if i > 0 {
+				time.Sleep(sampleGap)
+			}
+			temp, err := source()
+			if err != nil {
+				return 0, err
+			}
+			if i == 0 || temp < min {
+				min = temp
+			}
+			if i == 0 || temp > max {
+				max = temp
+			}
+			sum += temp
+		}
+		average := int(math.Round(float64(sum) / float64(samples)))
+		if os.Getenv("MODE") == "debug" {
+			log.Printf("Sampled %v readings: average %v, spread %v\n", samples, average, max-min)
+		}
+		return average, nil
+	}
+}
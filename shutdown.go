@@ -0,0 +1,40 @@
+package main
+
+// Ordered shutdown
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// closer is a subsystem stopped on shutdown. *http.Server is one as is.
+type closer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// closerFunc adapts a function to closer
+type closerFunc func(ctx context.Context) error
+
+func (f closerFunc) Shutdown(ctx context.Context) error {
+	return f(ctx)
+}
+
+// shutdownStep is a closer with the name it is logged under
+type shutdownStep struct {
+	name   string
+	closer closer
+}
+
+// runShutdown stops the steps in order, each logged and given at most
+// timeout. A failing step is logged and the following ones still run.
+func runShutdown(steps []shutdownStep, timeout time.Duration) {
+	for _, step := range steps {
+		log.Printf("Shutdown: %s\n", step.name)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := step.closer.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %s: %v\n", step.name, err)
+		}
+		cancel()
+	}
+}
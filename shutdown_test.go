@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunShutdownOrder(t *testing.T) {
+	var order []string
+	step := func(name string, err error) shutdownStep {
+		return shutdownStep{name, closerFunc(func(ctx context.Context) error {
+			order = append(order, name)
+			return err
+		})}
+	}
+	// a failing step does not stop the following ones
+	runShutdown([]shutdownStep{step("a", nil), step("b", errors.New("failed")), step("c", nil)}, time.Second)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got %v, want %v", order, want)
+	}
+}
+
+func TestRunShutdownServer(t *testing.T) {
+	srv := &http.Server{Addr: "127.0.0.1:0"}
+	runShutdown([]shutdownStep{{"server", srv}}, time.Second)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		t.Errorf("got %v after shutdown, want %v", err, http.ErrServerClosed)
+	}
+}
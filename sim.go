@@ -0,0 +1,50 @@
+package main
+
+// Simulated temperature source
+
+import (
+	"math"
+	"time"
+)
+
+// simulator models the CPU as a body heated at a constant rate by its load
+// and cooled towards the ambient temperature, faster while the fan runs
+type simulator struct {
+	fan        Fan
+	ambient    float64
+	heat       float64 // degrees per second added by the load
+	passive    float64 // cooling coefficient per second without the fan
+	fanCooling float64 // additional cooling coefficient per second with the fan
+
+	temp float64
+	last time.Time
+}
+
+func newSimulator(fan Fan, ambient float64, heat float64, passive float64, fanCooling float64) *simulator {
+	return &simulator{
+		fan:        fan,
+		ambient:    ambient,
+		heat:       heat,
+		passive:    passive,
+		fanCooling: fanCooling,
+		temp:       ambient,
+	}
+}
+
+// read advances the model to now and returns the temperature
+func (s *simulator) read() (int, error) {
+	now := time.Now()
+	if !s.last.IsZero() {
+		cooling := s.passive
+		if s.fan.State() == 1 {
+			cooling += s.fanCooling
+		}
+		// exact solution of dT/dt = heat - cooling * (T - ambient), which
+		// stays stable for long poll intervals
+		equilibrium := s.ambient + s.heat/cooling
+		dt := now.Sub(s.last).Seconds()
+		s.temp = equilibrium + (s.temp-equilibrium)*math.Exp(-cooling*dt)
+	}
+	s.last = now
+	return int(s.temp), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+// Control loop statistics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// stats are the control loop figures shared with the signal handler
+type stats struct {
+	mu          sync.Mutex
+	started     time.Time
+	temp        int
+	running     bool
+	mode        string
+	peakTemp    int
+	peakTime    time.Time
+	transitions int
+	readErrors  int
+}
+
+func newStats(running bool) *stats {
+	return &stats{started: time.Now(), running: running, mode: "normal"}
+}
+
+// setState records the fan state and mode after a failed read
+func (s *stats) setState(running bool, mode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if running != s.running {
+		s.transitions++
+	}
+	s.running = running
+	s.mode = mode
+}
+
+// readFailed counts a failed read
+func (s *stats) readFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readErrors++
+}
+
+// update records a temperature reading, the resulting fan state and the
+// control mode
+func (s *stats) update(temp int, running bool, mode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if running != s.running {
+		s.transitions++
+	}
+	s.temp = temp
+	s.running = running
+	s.mode = mode
+	if s.peakTime.IsZero() || temp > s.peakTemp {
+		s.peakTemp = temp
+		s.peakTime = time.Now()
+	}
+}
+
+// snapshot formats the current figures for the log
+func (s *stats) snapshot(start int, stop int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("temperature=%v fan=%s mode=%s start=%v stop=%v uptime=%v peak=%v peak_at=%s transitions=%v",
+		s.temp, stateName(s.running), s.mode, start, stop, time.Since(s.started).Round(time.Second),
+		s.peakTemp, s.peakTime.Format(time.RFC3339), s.transitions)
+}
+
+// stateReport is the machine readable state of the control loop
+type stateReport struct {
+	Input       string `json:"input"`
+	Temperature int    `json:"temperature"`
+	Fan         string `json:"fan"`
+	Mode        string `json:"mode"`
+	Start       int    `json:"start"`
+	Stop        int    `json:"stop"`
+}
+
+// report returns the current state for JSON output
+func (s *stats) report(input string, start int, stop int) stateReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stateReport{
+		Input:       input,
+		Temperature: s.temp,
+		Fan:         stateName(s.running),
+		Mode:        s.mode,
+		Start:       start,
+		Stop:        stop,
+	}
+}
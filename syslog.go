@@ -0,0 +1,150 @@
+package main
+
+// Remote syslog output
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogQueue is the number of log lines buffered for the syslog server
+// before further lines are dropped
+const syslogQueue = 64
+
+// syslogRetry is the delay between attempts to connect to the syslog server
+const syslogRetry = 10 * time.Second
+
+// logTimestamp is the date and time the log package puts in front of each
+// line
+const logTimestamp = "2006/01/02 15:04:05 "
+
+// syslogSeverity maps a log line to its syslog severity: "Warning:" lines
+// are warnings, "DEADMAN" lines critical and everything else informational
+func syslogSeverity(line string) syslog.Priority {
+	if len(line) >= len(logTimestamp) {
+		if _, err := time.Parse(logTimestamp, line[:len(logTimestamp)]); err == nil {
+			line = line[len(logTimestamp):]
+		}
+	}
+	switch {
+	case strings.HasPrefix(line, "Warning:"):
+		return syslog.LOG_WARNING
+	case strings.HasPrefix(line, "DEADMAN"):
+		return syslog.LOG_CRIT
+	}
+	return syslog.LOG_INFO
+}
+
+// syslogWriter forwards log lines to a syslog server from its own
+// goroutine, so a slow or unreachable server never blocks the control loop.
+// The goroutine keeps retrying until the server is reachable, and
+// syslog.Writer reconnects by itself when a later write fails. Messages
+// are sent as log/syslog formats them, RFC 3164 style but with an RFC 3339
+// timestamp: "<PRI>TIMESTAMP HOSTNAME pi-fan-control[PID]: MESSAGE", with
+// the daemon facility and the severity from syslogSeverity.
+type syslogWriter struct {
+	lines chan []byte
+	// abort stops the connection attempts; done is closed when the
+	// goroutine has finished
+	abort chan struct{}
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newSyslogWriter forwards to the server given as "udp://host:port" or
+// "tcp://host:port". Only an invalid server is an error; connecting
+// happens in the background.
+func newSyslogWriter(spec string) (*syslogWriter, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog server %q (expected 'udp://host:port' or 'tcp://host:port')", spec)
+	}
+	s := &syslogWriter{
+		lines: make(chan []byte, syslogQueue),
+		abort: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run(u.Scheme, u.Host)
+	return s, nil
+}
+
+// run connects to the server and writes the queued lines until the queue
+// is closed
+func (s *syslogWriter) run(network string, addr string) {
+	defer close(s.done)
+	var w *syslog.Writer
+	for {
+		var err error
+		w, err = syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "pi-fan-control")
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "syslog: %v, retrying in %v\n", err, syslogRetry)
+		select {
+		case <-time.After(syslogRetry):
+		case <-s.abort:
+			return
+		}
+	}
+	defer w.Close()
+	for line := range s.lines {
+		msg := string(line)
+		var err error
+		switch syslogSeverity(msg) {
+		case syslog.LOG_WARNING:
+			err = w.Warning(msg)
+		case syslog.LOG_CRIT:
+			err = w.Crit(msg)
+		default:
+			err = w.Info(msg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "syslog: %v\n", err)
+		}
+	}
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return len(p), nil
+	}
+	select {
+	case s.lines <- line:
+	default:
+	}
+	return len(p), nil
+}
+
+// close flushes the queued lines to the server, waiting at most timeout.
+// Lines written afterwards are dropped.
+func (s *syslogWriter) close(timeout time.Duration) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.lines)
+	close(s.abort)
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		fmt.Fprintf(os.Stderr, "syslog: lines still queued after %v, dropping them\n", timeout)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/syslog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogWriterFlushes(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	w, err := newSyslogWriter("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("fan on\n"))
+	w.close(5 * time.Second)
+	w.Write([]byte("after close\n"))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// daemon facility, informational severity
+	if got := string(buf[:n]); !strings.HasPrefix(got, "<30>") || !strings.Contains(got, "pi-fan-control[") || !strings.Contains(got, "fan on") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSyslogSeverity(t *testing.T) {
+	tests := map[string]syslog.Priority{
+		"2026/10/15 08:00:00 Fan: on (CPU temperature: 68)\n":                          syslog.LOG_INFO,
+		"2026/10/15 08:00:00 Warning: sensor missing\n":                                syslog.LOG_WARNING,
+		"2026/10/15 08:00:00 DEADMAN: control loop stalled for 30s, forcing fan on!\n": syslog.LOG_CRIT,
+		"Warning: without a timestamp\n":                                               syslog.LOG_WARNING,
+		"2026/10/15 08:00:00 Fan command 'x on' failed: Warning: busy\n":               syslog.LOG_INFO,
+	}
+	for line, want := range tests {
+		if got := syslogSeverity(line); got != want {
+			t.Errorf("%q: got %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestSyslogWriterUnreachable(t *testing.T) {
+	// nothing listens on a port just released
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	w, err := newSyslogWriter("tcp://" + addr)
+	if err != nil {
+		t.Fatalf("unreachable server rejected: %v", err)
+	}
+	for i := 0; i < 2*syslogQueue; i++ {
+		w.Write([]byte("line\n"))
+	}
+	start := time.Now()
+	w.close(5 * time.Second)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("close waited %v for an unreachable server", d)
+	}
+}
+
+func TestSyslogWriterInvalid(t *testing.T) {
+	for _, spec := range []string{"localhost:514", "http://localhost:514", "udp://"} {
+		if _, err := newSyslogWriter(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+// Prometheus textfile export for the node_exporter textfile collector
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const textfileName = "pifan.prom"
+
+type textfile struct {
+	dir      string
+	interval time.Duration
+	last     time.Time
+}
+
+// write exports the current figures, at most once per interval. The file is
+// written next to its final name and renamed so the collector never reads a
+// partial file.
+func (t *textfile) write(s *stats, input string) error {
+	if !t.last.IsZero() && time.Since(t.last) < t.interval {
+		return nil
+	}
+	t.last = time.Now()
+
+	tmp, err := ioutil.TempFile(t.dir, textfileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.WriteString(diskWrites.writer("textfile", tmp), s.prometheus(input)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(t.dir, textfileName))
+}
+
+// prometheus formats the current figures in the Prometheus text format
+func (s *stats) prometheus(input string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := 0
+	if s.running {
+		running = 1
+	}
+	var b strings.Builder
+	metric := func(name string, kind string, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	fmt.Fprintf(&b, "# HELP pifan_input Current control input.\n# TYPE pifan_input gauge\npifan_input{input=%q} %v\n", input, s.temp)
+	fmt.Fprintf(&b, "# HELP pifan_input_peak Highest control input since start.\n# TYPE pifan_input_peak gauge\npifan_input_peak{input=%q} %v\n", input, s.peakTemp)
+	metric("pifan_fan_running", "gauge", "Whether the fan is running.", running)
+	metric("pifan_fan_transitions_total", "counter", "Fan state changes since start.", s.transitions)
+	metric("pifan_uptime_seconds", "gauge", "Seconds since the daemon started.", int(time.Since(s.started).Seconds()))
+	b.WriteString("# HELP pifan_disk_written_bytes_total Bytes written to disk by subsystem.\n# TYPE pifan_disk_written_bytes_total counter\n")
+	names, totals := diskWrites.totals()
+	for i := range names {
+		fmt.Fprintf(&b, "pifan_disk_written_bytes_total{subsystem=%q} %v\n", names[i], totals[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,78 @@
+package main
+
+// Terminal dashboard
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// number of samples shown in the sparkline
+const tuiHistory = 60
+
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+// tui renders a live view of the control loop using ANSI escapes
+type tui struct {
+	out     io.Writer
+	history []int
+}
+
+func newTUI() *tui {
+	t := &tui{out: os.Stdout}
+	// hide the cursor while drawing
+	fmt.Fprint(t.out, "\033[?25l")
+	return t
+}
+
+// update records a sample and redraws the screen
+func (t *tui) update(r stateReport) {
+	t.history = append(t.history, r.Temperature)
+	if len(t.history) > tuiHistory {
+		t.history = t.history[len(t.history)-tuiHistory:]
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	b.WriteString("PiFan fan monitor\n\n")
+	fmt.Fprintf(&b, "  %-16s %v\n", r.Input+":", r.Temperature)
+	fmt.Fprintf(&b, "  Fan:             %s\n", r.Fan)
+	fmt.Fprintf(&b, "  Mode:            %s\n", r.Mode)
+	fmt.Fprintf(&b, "  Thresholds:      start %v / stop %v\n\n", r.Start, r.Stop)
+	fmt.Fprintf(&b, "  %s\n\n", sparkline(t.history))
+	fmt.Fprintf(&b, "  Updated: %s\n", time.Now().Format("15:04:05"))
+	fmt.Fprint(t.out, b.String())
+}
+
+// close restores the terminal
+func (t *tui) close() {
+	fmt.Fprint(t.out, "\033[?25h\n")
+}
+
+func sparkline(values []int) string {
+	if len(values) == 0 {
+		return ""
+	}
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > min {
+			i = (v - min) * (len(sparkChars) - 1) / (max - min)
+		}
+		b.WriteRune(sparkChars[i])
+	}
+	fmt.Fprintf(&b, " (%v..%v)", min, max)
+	return b.String()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTUIShowsInputAndMode(t *testing.T) {
+	var out bytes.Buffer
+	ui := &tui{out: &out}
+	ui.update(stateReport{Input: "Load", Temperature: 42, Fan: "on", Mode: "purge", Start: 80, Stop: 50})
+	for _, want := range []string{"Load:            42", "Mode:            purge"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q missing from %q", want, out.String())
+		}
+	}
+}